@@ -3,11 +3,17 @@ module github.com/aggresss/playground-streaming/webrtc-go
 go 1.20
 
 require (
+	github.com/abema/go-mp4 v0.10.1
+	github.com/at-wat/ebml-go v0.17.0
 	github.com/gin-gonic/gin v1.9.1
 	github.com/google/uuid v1.5.0
 	github.com/pion/interceptor v0.1.26-0.20240131110809-5574fda4dd5c
+	github.com/pion/rtcp v1.2.13
+	github.com/pion/rtp v1.8.3
 	github.com/pion/sdp v1.3.0
+	github.com/pion/sdp/v3 v3.0.6
 	github.com/pion/webrtc/v3 v3.2.24
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -33,10 +39,7 @@ require (
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns v0.0.8 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.13 // indirect
-	github.com/pion/rtp v1.8.3 // indirect
 	github.com/pion/sctp v1.8.8 // indirect
-	github.com/pion/sdp/v3 v3.0.6 // indirect
 	github.com/pion/srtp/v2 v2.0.18 // indirect
 	github.com/pion/stun v0.6.1 // indirect
 	github.com/pion/transport/v2 v2.2.3 // indirect
@@ -52,5 +55,4 @@ require (
 	golang.org/x/sys v0.11.0 // indirect
 	golang.org/x/text v0.12.0 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,297 @@
+package whep
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	MAIN_RENDITION = "main"
+	ABR_INTERVAL   = time.Millisecond * 500
+	// a higher rendition is taken once the estimate has covered its bitrate
+	// with this margin for ABR_UP_HOLD, a lower one as soon as the estimate
+	// falls under ABR_DOWN_RATIO of the current bitrate
+	ABR_UP_RATIO   = 1.2
+	ABR_UP_HOLD    = time.Second * 4
+	ABR_DOWN_RATIO = 0.9
+)
+
+// rendition is one bitrate of the stream video, the main source is
+// MAIN_RENDITION and the others come from sourceConfig.Renditions.
+type rendition struct {
+	name    string
+	bitrate int
+}
+
+// renditionSource plays a source whose video only reaches the subscribers
+// of its rendition.
+type renditionSource struct {
+	writer *renditionWriter
+	source streamSource
+}
+
+func (r *renditionSource) Run(ctx context.Context, _ sampleWriter, group *mediaClockGroup) {
+	r.source.Run(ctx, r.writer, group)
+}
+
+// VideoMimeTypes is empty since the codec of a rendition is the codec of the
+// main source.
+func (r *renditionSource) VideoMimeTypes() []string {
+	return nil
+}
+
+// renditionWriter tags the video samples with the rendition and drops the
+// audio, the audio of the stream comes from the main source.
+type renditionWriter struct {
+	stream    *stream
+	rendition string
+}
+
+func (w *renditionWriter) Name() string {
+	return w.stream.name + "@" + w.rendition
+}
+
+func (w *renditionWriter) WriteSample(mimeType string, sample media.Sample) {
+	if strings.HasPrefix(strings.ToLower(mimeType), "audio/") {
+		return
+	}
+	w.stream.writeRenditionSample(w.rendition, mimeType, sample)
+}
+
+// Renditions lists the renditions in ascending bitrate, the simulcast
+// layers of the WHIP publisher or the renditions of the disk files.
+func (s *stream) Renditions() []rendition {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	return s.renditionsLocked()
+}
+
+// HasRendition reports whether the stream has a rendition of the name, the
+// default one included.
+func (s *stream) HasRendition(name string) bool {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	return s.hasRendition(name)
+}
+
+// renditionsLocked is Renditions for a caller holding s.locker.
+func (s *stream) renditionsLocked() []rendition {
+	if s.publisher != nil {
+		return s.publisher.Layers()
+	}
+	return s.renditions
+}
+
+// defaultRendition is the first layer of a simulcast publisher, else the
+// main video, the caller must hold s.locker.
+func (s *stream) defaultRendition() string {
+	if s.publisher != nil {
+		if layer := s.publisher.DefaultLayer(); layer != "" {
+			return layer
+		}
+	}
+	return MAIN_RENDITION
+}
+
+func (s *stream) hasRendition(name string) bool {
+	if name == s.defaultRendition() {
+		return true
+	}
+	for _, r := range s.renditionsLocked() {
+		if r.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriberRendition is the rendition the subscriber plays when the source
+// of the stream changes, its pinned one while the source has it, the
+// caller must hold s.locker.
+func (s *stream) subscriberRendition(c *whepClient) string {
+	if c.pinnedRendition != "" && s.hasRendition(c.pinnedRendition) {
+		return c.pinnedRendition
+	}
+	return s.defaultRendition()
+}
+
+// SetRendition makes the subscriber switch to the rendition at its next
+// keyframe, which is asked from the publisher right away.
+func (c *whepClient) SetRendition(name string) {
+	if c.switchRendition(name) {
+		c.stream.RequestRenditionKeyframe(name)
+	}
+}
+
+// switchRendition is SetRendition without the keyframe request, for a
+// caller holding the stream locker. It reports whether a switch is pending.
+func (c *whepClient) switchRendition(name string) bool {
+	c.renditionLocker.Lock()
+	defer c.renditionLocker.Unlock()
+	if name == c.rendition {
+		c.pendingRendition = ""
+		return false
+	}
+	c.pendingRendition = name
+	return true
+}
+
+// Rendition returns the rendition played and the one switched to.
+func (c *whepClient) Rendition() (string, string) {
+	c.renditionLocker.Lock()
+	defer c.renditionLocker.Unlock()
+	return c.rendition, c.pendingRendition
+}
+
+// takesVideo reports whether a video sample of the rendition goes to the
+// subscriber, a pending switch happens on the first keyframe of the new
+// rendition so the decoder never gets frames of two encodings mixed, and a
+// subscriber waiting for a keyframe skips the frames before it.
+func (c *whepClient) takesVideo(rendition string, keyframe bool) bool {
+	c.renditionLocker.Lock()
+	defer c.renditionLocker.Unlock()
+	switch {
+	case rendition == c.rendition:
+	case rendition == c.pendingRendition && keyframe:
+		log.Println("Switch Rendition:", c.stream.name, c.rendition, "->", rendition)
+		c.rendition = rendition
+		c.pendingRendition = ""
+	default:
+		return false
+	}
+	if c.waitKeyframe {
+		if !keyframe {
+			return false
+		}
+		c.waitKeyframe = false
+	}
+	return true
+}
+
+// isKeyframe reports whether the Annex-B H264/H265 access unit has an IDR
+// or IRAP picture, or the VP8/VP9 frame is a key frame. AV1 is never
+// switched.
+func isKeyframe(mimeType string, data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		// the P bit of the frame tag is 0 for a key frame
+		return data[0]&0x01 == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		// frame_marker(2) profile_low_bit profile_high_bit
+		// [reserved_zero] show_existing_frame frame_type
+		shift := 2
+		if data[0]&0x30 == 0x30 {
+			shift = 1
+		}
+		return data[0]&0xc0 == 0x80 && (data[0]>>(shift+1))&0x01 == 0 && (data[0]>>shift)&0x01 == 0
+	}
+	h265 := strings.EqualFold(mimeType, webrtc.MimeTypeH265)
+	if !h265 && !strings.EqualFold(mimeType, webrtc.MimeTypeH264) {
+		return false
+	}
+	for _, nal := range bytes.Split(data, []byte{0, 0, 1}) {
+		if len(nal) == 0 {
+			continue
+		}
+		if h265 {
+			if t := (nal[0] >> 1) & 0x3f; t >= 16 && t <= 23 {
+				return true
+			}
+		} else if nal[0]&0x1f == 5 {
+			return true
+		}
+	}
+	return false
+}
+
+// abrController moves one subscriber between the renditions of its stream
+// following the target bitrate of its GCC estimator. The renditions are
+// read on every tick since a simulcast publisher may come and go. It stops
+// once the session of the subscriber is closing.
+type abrController struct {
+	client    *whepClient
+	estimator cc.BandwidthEstimator
+
+	upSince time.Time
+}
+
+func newABRController(c *whepClient, estimator cc.BandwidthEstimator) *abrController {
+	return &abrController{
+		client:    c,
+		estimator: estimator,
+	}
+}
+
+func (a *abrController) Run() {
+	go a.run()
+}
+
+func (a *abrController) run() {
+	ticker := time.NewTicker(ABR_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.client.ctx.Done():
+			return
+		case now := <-ticker.C:
+			renditions := a.client.stream.Renditions()
+			if len(renditions) < 2 {
+				a.upSince = time.Time{}
+				continue
+			}
+			current, pending := a.client.Rendition()
+			if pending != "" {
+				current = pending
+			}
+			target := a.estimator.GetTargetBitrate()
+			next := a.next(renditions, current, target, now)
+			if next != current {
+				log.Println("ABR:", a.client.stream.name, current, "->", next, "target", target)
+				a.client.SetRendition(next)
+			}
+		}
+	}
+}
+
+// next picks the rendition for the target bitrate, going down at once and
+// going up one rendition at a time after ABR_UP_HOLD.
+func (a *abrController) next(renditions []rendition, current string, target int, now time.Time) string {
+	i := len(renditions)
+	for j, r := range renditions {
+		if r.name == current {
+			i = j
+		}
+	}
+	if i == len(renditions) {
+		return renditions[0].name
+	}
+	if float64(target) < ABR_DOWN_RATIO*float64(renditions[i].bitrate) {
+		a.upSince = time.Time{}
+		for i > 0 && float64(target) < ABR_DOWN_RATIO*float64(renditions[i].bitrate) {
+			i--
+		}
+		return renditions[i].name
+	}
+	if i+1 < len(renditions) && float64(target) >= ABR_UP_RATIO*float64(renditions[i+1].bitrate) {
+		if a.upSince.IsZero() {
+			a.upSince = now
+		}
+		if now.Sub(a.upSince) >= ABR_UP_HOLD {
+			a.upSince = time.Time{}
+			return renditions[i+1].name
+		}
+		return current
+	}
+	a.upSince = time.Time{}
+	return current
+}
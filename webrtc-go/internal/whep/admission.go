@@ -0,0 +1,242 @@
+package whep
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ADMISSION_SWEEP_INTERVAL is how often the rate limiter drops the buckets
+// of the clients that went quiet.
+const ADMISSION_SWEEP_INTERVAL = time.Minute
+
+var (
+	errRateLimited     = errors.New("too many requests")
+	errRequestTooLarge = errors.New("request body too large")
+)
+
+// admissionConfig limits the sessions and the requests so that a burst of
+// POSTs cannot exhaust the file descriptors and goroutines of the server, a
+// zero limit is no limit.
+type admissionConfig struct {
+	// WHEP and WHIP sessions of the server and of one client IP, WHEP
+	// sessions of one stream
+	MaxSessions       int `yaml:"max_sessions"`
+	MaxStreamSessions int `yaml:"max_stream_sessions"`
+	MaxIPSessions     int `yaml:"max_ip_sessions"`
+	// requests per second of one client IP, up to RequestBurst at once,
+	// CORS preflights aside
+	RequestRate  float64 `yaml:"request_rate"`
+	RequestBurst int     `yaml:"request_burst"`
+	// bytes of an SDP offer or trickle ICE fragment
+	MaxSDPSize int64 `yaml:"max_sdp_size"`
+	// sent with a 503 at capacity, a 429 tells when the next token is due
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+func (a *admissionConfig) validate() []error {
+	var errs []error
+	if a.MaxSessions < 0 || a.MaxStreamSessions < 0 || a.MaxIPSessions < 0 {
+		errs = append(errs, fmt.Errorf("admission: session limits must not be negative"))
+	}
+	if a.RequestRate < 0 {
+		errs = append(errs, fmt.Errorf("admission: request_rate must not be negative"))
+	}
+	if a.RequestRate > 0 && a.RequestBurst < 1 {
+		errs = append(errs, fmt.Errorf("admission: request_burst must be at least 1 with a request_rate"))
+	}
+	if a.MaxSDPSize < 0 {
+		errs = append(errs, fmt.Errorf("admission: max_sdp_size must not be negative"))
+	}
+	if a.RetryAfter < time.Second {
+		errs = append(errs, fmt.Errorf("admission: retry_after must be at least 1s"))
+	}
+	return errs
+}
+
+// retryAfterError is a 503 or 429 error telling the client when to retry.
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// tokenBucket is the request budget of one client IP.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// admission counts the sessions by stream and client IP, and the requests
+// of every client IP. A session is counted from its admission, before its
+// peer connection is built, until it is removed.
+type admission struct {
+	config admissionConfig
+
+	locker         sync.Mutex
+	sessions       int
+	streamSessions map[string]int
+	ipSessions     map[string]int
+	buckets        map[string]*tokenBucket
+	lastSweep      time.Time
+	// the requests turned away, by reason, for the metrics
+	rejected map[string]uint64
+}
+
+func newAdmission(config admissionConfig) *admission {
+	return &admission{
+		config:         config,
+		streamSessions: make(map[string]int),
+		ipSessions:     make(map[string]int),
+		buckets:        make(map[string]*tokenBucket),
+		lastSweep:      time.Now(),
+		rejected:       make(map[string]uint64),
+	}
+}
+
+// admit counts a new session of the client IP, and of the stream unless it
+// is empty, or returns a 503 error when a limit is reached. A nil error must
+// be followed by leave with the same arguments.
+func (a *admission) admit(stream, ip string) error {
+	a.locker.Lock()
+	defer a.locker.Unlock()
+	var reason string
+	switch {
+	case a.config.MaxSessions > 0 && a.sessions >= a.config.MaxSessions:
+		reason = "sessions"
+	case stream != "" && a.config.MaxStreamSessions > 0 && a.streamSessions[stream] >= a.config.MaxStreamSessions:
+		reason = "stream_sessions"
+	case a.config.MaxIPSessions > 0 && a.ipSessions[ip] >= a.config.MaxIPSessions:
+		reason = "ip_sessions"
+	}
+	if reason != "" {
+		a.rejected[reason]++
+		return &retryAfterError{
+			err:   wrapError(errAtCapacity, fmt.Errorf("%s limit reached", reason)),
+			after: a.config.RetryAfter,
+		}
+	}
+	a.sessions++
+	if stream != "" {
+		a.streamSessions[stream]++
+	}
+	a.ipSessions[ip]++
+	return nil
+}
+
+func (a *admission) leave(stream, ip string) {
+	a.locker.Lock()
+	defer a.locker.Unlock()
+	a.sessions--
+	if stream != "" {
+		if a.streamSessions[stream]--; a.streamSessions[stream] <= 0 {
+			delete(a.streamSessions, stream)
+		}
+	}
+	if a.ipSessions[ip]--; a.ipSessions[ip] <= 0 {
+		delete(a.ipSessions, ip)
+	}
+}
+
+// allow takes a token of the client IP, or returns a 429 error telling when
+// the next one is due.
+func (a *admission) allow(ip string, now time.Time) error {
+	if a.config.RequestRate <= 0 {
+		return nil
+	}
+	a.locker.Lock()
+	defer a.locker.Unlock()
+	burst := float64(a.config.RequestBurst)
+	if now.Sub(a.lastSweep) >= ADMISSION_SWEEP_INTERVAL {
+		// a bucket refilled up to the burst is the same as no bucket
+		full := time.Duration(burst / a.config.RequestRate * float64(time.Second))
+		for key, b := range a.buckets {
+			if now.Sub(b.updated) >= full {
+				delete(a.buckets, key)
+			}
+		}
+		a.lastSweep = now
+	}
+	b, ok := a.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: burst, updated: now}
+		a.buckets[ip] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*a.config.RequestRate)
+	b.updated = now
+	if b.tokens < 1 {
+		a.rejected["rate"]++
+		return &retryAfterError{
+			err:   errRateLimited,
+			after: time.Duration((1 - b.tokens) / a.config.RequestRate * float64(time.Second)),
+		}
+	}
+	b.tokens--
+	return nil
+}
+
+// rejectedCounts copies the rejections by reason.
+func (a *admission) rejectedCounts() map[string]float64 {
+	a.locker.Lock()
+	defer a.locker.Unlock()
+	counts := map[string]float64{"sessions": 0, "stream_sessions": 0, "ip_sessions": 0, "rate": 0, "sdp_size": 0}
+	for reason, n := range a.rejected {
+		counts[reason] = float64(n)
+	}
+	return counts
+}
+
+// readSDP reads an SDP offer or fragment of at most MaxSDPSize bytes.
+func (a *admission) readSDP(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if a.config.MaxSDPSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, a.config.MaxSDPSize)
+	}
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		a.locker.Lock()
+		a.rejected["sdp_size"]++
+		a.locker.Unlock()
+		return nil, wrapError(errRequestTooLarge, fmt.Errorf("sdp over %d bytes", tooLarge.Limit))
+	}
+	if err != nil {
+		return nil, wrapError(errBadRequest, err)
+	}
+	return body, nil
+}
+
+// clientIP is the address of the peer of the HTTP connection, a proxy in
+// front of the server makes all its clients one.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeRetryAfter sets the Retry-After header of a retryAfterError, in whole
+// seconds rounded up.
+func writeRetryAfter(w http.ResponseWriter, err error) {
+	var retry *retryAfterError
+	if errors.As(err, &retry) {
+		seconds := int(math.Ceil(retry.after.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+}
@@ -0,0 +1,163 @@
+package whep
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the actions a token is signed for, WHEP playback and WHIP publishing
+	ACTION_PLAY    = "play"
+	ACTION_PUBLISH = "publish"
+)
+
+var (
+	errUnauthorized = errors.New("token invalid")
+	errForbidden    = errors.New("token not allowed for stream or action")
+)
+
+// tokenValidator checks the bearer token of a request against the stream and
+// the action it addresses. It returns errUnauthorized when the token is
+// unknown or expired and errForbidden when the token is valid but not for
+// this stream or action.
+type tokenValidator interface {
+	Validate(token, stream, action string) error
+}
+
+// staticTokenValidator accepts a fixed set of tokens for every stream.
+type staticTokenValidator struct {
+	tokens map[string]bool
+}
+
+func newStaticTokenValidator(tokens []string) *staticTokenValidator {
+	v := &staticTokenValidator{tokens: make(map[string]bool)}
+	for _, token := range tokens {
+		if token != "" {
+			v.tokens[token] = true
+		}
+	}
+	return v
+}
+
+func (v *staticTokenValidator) Validate(token, stream, action string) error {
+	if !v.tokens[token] {
+		return errUnauthorized
+	}
+	return nil
+}
+
+// hmacTokenValidator accepts tokens of the form
+// "<path>:<action>:<expiry>:<signature>", action is play or publish, expiry
+// is a unix timestamp and signature is the hex HMAC-SHA256 of
+// "<path>:<action>:<expiry>". The path is either a stream such as
+// "/live/livestream" or a prefix ending with "/" such as "/live/" that covers
+// all its streams.
+type hmacTokenValidator struct {
+	secret []byte
+}
+
+func newHMACTokenValidator(secret string) *hmacTokenValidator {
+	return &hmacTokenValidator{secret: []byte(secret)}
+}
+
+func (v *hmacTokenValidator) sign(payload string) string {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (v *hmacTokenValidator) Validate(token, stream, action string) error {
+	i := strings.LastIndex(token, ":")
+	if i < 0 {
+		return errUnauthorized
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(v.sign(payload))) {
+		return errUnauthorized
+	}
+	i = strings.LastIndex(payload, ":")
+	if i < 0 {
+		return errUnauthorized
+	}
+	j := strings.LastIndex(payload[:i], ":")
+	if j < 0 {
+		return errUnauthorized
+	}
+	allowed, allowedAction := payload[:j], payload[j+1:i]
+	expiry, err := strconv.ParseInt(payload[i+1:], 10, 64)
+	if err != nil || time.Now().Unix() >= expiry {
+		return errUnauthorized
+	}
+	if allowedAction != action {
+		return errForbidden
+	}
+	if allowed != stream && !(strings.HasSuffix(allowed, "/") && strings.HasPrefix(stream, allowed)) {
+		return errForbidden
+	}
+	return nil
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// authorize passes when no validator is configured or when any validator
+// accepts the token, a token that is only rejected for its stream or action
+// is reported as errForbidden.
+func (h *whepHandler) authorize(r *http.Request, stream, action string) error {
+	if len(h.tokenValidators) == 0 {
+		return nil
+	}
+	token := bearerToken(r)
+	if token == "" {
+		return errUnauthorized
+	}
+	result := errUnauthorized
+	for _, v := range h.tokenValidators {
+		err := v.Validate(token, stream, action)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errForbidden) {
+			result = errForbidden
+		}
+	}
+	return result
+}
+
+// authorizeMetrics checks the scrape token of /metrics, which is separate
+// from the stream tokens so a scraper never holds a token that plays or
+// publishes. Without a scrape token /metrics is open.
+func (h *whepHandler) authorizeMetrics(r *http.Request) error {
+	if h.metricsToken == "" {
+		return nil
+	}
+	if !hmac.Equal([]byte(bearerToken(r)), []byte(h.metricsToken)) {
+		return errUnauthorized
+	}
+	return nil
+}
+
+// allowOrigin allows every origin by default, but only the configured ones
+// once tokens are required, so that any page cannot use a viewer's token.
+func (h *whepHandler) allowOrigin(origin string) bool {
+	if len(h.allowOrigins) == 0 {
+		return len(h.tokenValidators) == 0
+	}
+	for _, allowed := range h.allowOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
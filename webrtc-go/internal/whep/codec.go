@@ -0,0 +1,103 @@
+package whep
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// offeredVideoCodecs lists the video mime types of the first video section
+// of the offer in the order of its payload types, which is the preference
+// order of the browser (RTCRtpTransceiver.setCodecPreferences).
+func offeredVideoCodecs(offer string) ([]string, error) {
+	var sd sdp.SessionDescription
+	if err := sd.Unmarshal([]byte(offer)); err != nil {
+		return nil, err
+	}
+	for _, md := range sd.MediaDescriptions {
+		if md.MediaName.Media != "video" {
+			continue
+		}
+		names := make(map[string]string)
+		for _, attr := range md.Attributes {
+			if attr.Key != "rtpmap" {
+				continue
+			}
+			// <payload type> <encoding name>/<clock rate>[/<channels>]
+			if fields := strings.Fields(attr.Value); len(fields) == 2 {
+				names[fields[0]] = strings.Split(fields[1], "/")[0]
+			}
+		}
+		var mimeTypes []string
+		for _, format := range md.MediaName.Formats {
+			if name, ok := names[format]; ok {
+				mimeTypes = append(mimeTypes, "video/"+name)
+			}
+		}
+		return mimeTypes, nil
+	}
+	return nil, nil
+}
+
+// selectVideoCodec picks the first codec of the offer that the stream has a
+// rendition of. An offer without video gets the first rendition, the track
+// is then left out of the answer.
+func selectVideoCodec(offer string, available []string) (string, error) {
+	if len(available) == 0 {
+		return webrtc.MimeTypeH264, nil
+	}
+	offered, err := offeredVideoCodecs(offer)
+	if err != nil {
+		return "", err
+	}
+	if len(offered) == 0 {
+		return available[0], nil
+	}
+	for _, mimeType := range offered {
+		for _, candidate := range available {
+			if strings.EqualFold(mimeType, candidate) {
+				return candidate, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("offer has none of the stream video codecs %v", available)
+}
+
+// offeredSimulcastRIDs lists the RIDs of the a=simulcast:send attribute of
+// the first video section of the offer, e.g. [h m l] for "send h;m;~l".
+// Alternatives of a layer are kept, paused ones lose their ~.
+func offeredSimulcastRIDs(offer string) ([]string, error) {
+	var sd sdp.SessionDescription
+	if err := sd.Unmarshal([]byte(offer)); err != nil {
+		return nil, err
+	}
+	for _, md := range sd.MediaDescriptions {
+		if md.MediaName.Media != "video" {
+			continue
+		}
+		value, ok := md.Attribute("simulcast")
+		if !ok {
+			return nil, nil
+		}
+		// send <rid list> [recv <rid list>]
+		fields := strings.Fields(value)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fields[i] != "send" {
+				continue
+			}
+			var rids []string
+			for _, layer := range strings.Split(fields[i+1], ";") {
+				for _, rid := range strings.Split(layer, ",") {
+					if rid = strings.TrimPrefix(rid, "~"); rid != "" {
+						rids = append(rids, rid)
+					}
+				}
+			}
+			return rids, nil
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,555 @@
+package whep
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the server configuration. The defaults come from the constants
+// of server.go, then the YAML file of -config, the environment variables and
+// the command line flags override them in that order.
+type config struct {
+	HTTPAddr     string                   `yaml:"http_addr"`
+	Candidates   []string                 `yaml:"candidates"`
+	ICEUDPPort   int                      `yaml:"ice_udp_port"`
+	ICETCPPort   int                      `yaml:"ice_tcp_port"`
+	ICEServers   iceServersConfig         `yaml:"ice_servers"`
+	AllowOrigins []string                 `yaml:"allow_origins"`
+	Auth         authConfig               `yaml:"auth"`
+	Source       sourceConfig             `yaml:"source"`
+	Paths        map[string]*sourceConfig `yaml:"paths"`
+	Codecs       codecsConfig             `yaml:"codecs"`
+	Interceptors interceptorConfig        `yaml:"interceptors"`
+	GOPCache     gopCacheConfig           `yaml:"gop_cache"`
+	Admission    admissionConfig          `yaml:"admission"`
+	// a session not connected this long after its answer is removed, a
+	// connected one once ICE failed, ice_failed_timeout after it was
+	// disconnected
+	ConnectTimeout         time.Duration `yaml:"connect_timeout"`
+	ICEDisconnectedTimeout time.Duration `yaml:"ice_disconnected_timeout"`
+	ICEFailedTimeout       time.Duration `yaml:"ice_failed_timeout"`
+
+	DefaultProfile string             `yaml:"default_profile"`
+	Profiles       map[string]profile `yaml:"profiles"`
+}
+
+type authConfig struct {
+	Tokens     []string `yaml:"tokens"`
+	HMACSecret string   `yaml:"hmac_secret"`
+	// MetricsToken is the bearer token of /metrics, which is open without it
+	MetricsToken string `yaml:"metrics_token"`
+}
+
+// sourceConfig is the disk source of a stream. Source is played by every
+// stream without an entry in Paths, a path entry takes the files of Source
+// only when it sets none of media_file, audio_file and video_file, and the
+// durations and loop it leaves unset.
+type sourceConfig struct {
+	MediaFile         string        `yaml:"media_file"`
+	AudioFile         string        `yaml:"audio_file"`
+	VideoFile         string        `yaml:"video_file"`
+	H265File          string        `yaml:"h265_file"`
+	IVFFiles          []string      `yaml:"ivf_files"`
+	OggPageDuration   time.Duration `yaml:"ogg_page_duration"`
+	H264FrameDuration time.Duration `yaml:"h264_frame_duration"`
+	Loop              *bool         `yaml:"loop"`
+	// bits per second of the video, required with Renditions
+	Bitrate    int               `yaml:"bitrate"`
+	Renditions []renditionConfig `yaml:"renditions"`
+
+	// the IVF renditions opened by whepHandler.Init
+	ivfSources []*ivfSource
+}
+
+// renditionConfig is another encoding of the video of a source in the same
+// codec, each GCC subscriber plays the one fitting its estimate. Its audio
+// is dropped.
+type renditionConfig struct {
+	Name      string `yaml:"name"`
+	MediaFile string `yaml:"media_file"`
+	VideoFile string `yaml:"video_file"`
+	Bitrate   int    `yaml:"bitrate"`
+}
+
+// codecsConfig replaces the default codecs of the variant, an empty list
+// keeps the defaults of its kind.
+type codecsConfig struct {
+	Audio []codecConfig `yaml:"audio"`
+	Video []codecConfig `yaml:"video"`
+}
+
+type codecConfig struct {
+	MimeType    string `yaml:"mime_type"`
+	ClockRate   uint32 `yaml:"clock_rate"`
+	Channels    uint16 `yaml:"channels"`
+	Fmtp        string `yaml:"fmtp"`
+	PayloadType uint8  `yaml:"payload_type"`
+}
+
+// interceptorConfig tunes the interceptors, the profile of a session
+// decides which of them it has.
+type interceptorConfig struct {
+	NACKGeneratorSize     uint16        `yaml:"nack_generator_size"`
+	NACKGeneratorInterval time.Duration `yaml:"nack_generator_interval"`
+	NACKResponderSize     uint16        `yaml:"nack_responder_size"`
+	PlayoutDelayMin       time.Duration `yaml:"playout_delay_min"`
+	PlayoutDelayMax       time.Duration `yaml:"playout_delay_max"`
+	GCCInitialBitrate     int           `yaml:"gcc_initial_bitrate"`
+}
+
+// iceServersConfig is either the ICE_SERVERS string or a YAML list of
+// urls/username/credential entries.
+type iceServersConfig []webrtc.ICEServer
+
+func (s *iceServersConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		servers, err := parseICEServers(value.Value)
+		if err != nil {
+			return err
+		}
+		*s = servers
+		return nil
+	}
+	var entries []struct {
+		URLs       []string `yaml:"urls"`
+		Username   string   `yaml:"username"`
+		Credential string   `yaml:"credential"`
+	}
+	if err := value.Decode(&entries); err != nil {
+		return err
+	}
+	*s = nil
+	for _, entry := range entries {
+		server := webrtc.ICEServer{URLs: entry.URLs, Username: entry.Username}
+		if entry.Credential != "" {
+			server.Credential = entry.Credential
+		}
+		*s = append(*s, server)
+	}
+	return nil
+}
+
+func newConfig(defaultProfile string) *config {
+	loop := VOD_LOOP
+	return &config{
+		HTTPAddr:   HTTP_ADDR,
+		Candidates: []string{CANDIDATE},
+		ICEUDPPort: ICE_UDP_PORT,
+		ICETCPPort: ICE_TCP_PORT,
+		Source: sourceConfig{
+			AudioFile:         AUDIO_FILE_NAME,
+			VideoFile:         VIDEO_FILE_NAME,
+			OggPageDuration:   OGG_PAGE_DURATION,
+			H264FrameDuration: H264_FRAME_DURATION,
+			Loop:              &loop,
+		},
+		Interceptors:           defaultInterceptors,
+		GOPCache:               defaultGOPCache,
+		Admission:              defaultAdmission,
+		ConnectTimeout:         CONNECT_TIMEOUT,
+		ICEDisconnectedTimeout: ICE_DISCONNECTED_TIMEOUT,
+		ICEFailedTimeout:       ICE_FAILED_TIMEOUT,
+		DefaultProfile:         defaultProfile,
+	}
+}
+
+// loadConfig reads the configuration of the command line arguments, the
+// errors of every setting are reported together.
+func loadConfig(args []string, profileName string) (*config, error) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	httpAddr := flags.String("http-addr", "", "HTTP listen address")
+	candidates := flags.String("candidates", "", "comma separated ICE host candidate IPs")
+	iceUDPPort := flags.Int("ice-udp-port", 0, "ICE UDP mux port, 0 disables it where supported")
+	iceTCPPort := flags.Int("ice-tcp-port", 0, "ICE TCP mux port, 0 disables it where supported")
+	mediaFile := flags.String("media-file", "", "MP4, MKV or WebM file of the default source")
+	loop := flags.Bool("loop", VOD_LOOP, "loop the files of the default source")
+	defaultProfile := flags.String("profile", "", "profile of the sessions without ?profile=")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	c := newConfig(profileName)
+	if *configFile != "" {
+		if err := c.readFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.readEnv(); err != nil {
+		return nil, err
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "http-addr":
+			c.HTTPAddr = *httpAddr
+		case "candidates":
+			c.Candidates = splitList(*candidates)
+		case "ice-udp-port":
+			c.ICEUDPPort = *iceUDPPort
+		case "ice-tcp-port":
+			c.ICETCPPort = *iceTCPPort
+		case "media-file":
+			c.Source.MediaFile = *mediaFile
+		case "loop":
+			c.Source.Loop = loop
+		case "profile":
+			c.DefaultProfile = *defaultProfile
+		}
+	})
+	for _, source := range c.Paths {
+		if source != nil {
+			source.inherit(&c.Source)
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *config) readFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("config %s: %w", fileName, err)
+	}
+	return nil
+}
+
+// readEnv applies the environment variables, the names are the constants of
+// server.go plus the settings that have no constant.
+func (c *config) readEnv() error {
+	var errs []error
+	setString := func(name string, value *string) {
+		if s := os.Getenv(name); s != "" {
+			*value = s
+		}
+	}
+	setList := func(name string, value *[]string) {
+		if s := os.Getenv(name); s != "" {
+			*value = splitList(s)
+		}
+	}
+	setInt := func(name string, value *int) {
+		if s := os.Getenv(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+			*value = n
+		}
+	}
+	setDuration := func(name string, value *time.Duration) {
+		if s := os.Getenv(name); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+			*value = d
+		}
+	}
+	setString("HTTP_ADDR", &c.HTTPAddr)
+	setString("DEFAULT_PROFILE", &c.DefaultProfile)
+	setList("CANDIDATE", &c.Candidates)
+	setInt("ICE_UDP_PORT", &c.ICEUDPPort)
+	setInt("ICE_TCP_PORT", &c.ICETCPPort)
+	setString("MEDIA_FILE_NAME", &c.Source.MediaFile)
+	setString("AUDIO_FILE_NAME", &c.Source.AudioFile)
+	setString("VIDEO_FILE_NAME", &c.Source.VideoFile)
+	setString("H265_FILE_NAME", &c.Source.H265File)
+	setList("IVF_FILE_NAMES", &c.Source.IVFFiles)
+	setDuration("OGG_PAGE_DURATION", &c.Source.OggPageDuration)
+	setDuration("H264_FRAME_DURATION", &c.Source.H264FrameDuration)
+	setInt("GOP_CACHE_MAX_FRAMES", &c.GOPCache.MaxFrames)
+	setInt("MAX_SESSIONS", &c.Admission.MaxSessions)
+	setInt("MAX_STREAM_SESSIONS", &c.Admission.MaxStreamSessions)
+	setInt("MAX_IP_SESSIONS", &c.Admission.MaxIPSessions)
+	setDuration("CONNECT_TIMEOUT", &c.ConnectTimeout)
+	setDuration("ICE_DISCONNECTED_TIMEOUT", &c.ICEDisconnectedTimeout)
+	setDuration("ICE_FAILED_TIMEOUT", &c.ICEFailedTimeout)
+	if s := os.Getenv("VOD_LOOP"); s != "" {
+		loop, err := strconv.ParseBool(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("VOD_LOOP: %w", err))
+		}
+		c.Source.Loop = &loop
+	}
+	setList("AUTH_TOKENS", &c.Auth.Tokens)
+	setString("AUTH_HMAC_SECRET", &c.Auth.HMACSecret)
+	setString("METRICS_TOKEN", &c.Auth.MetricsToken)
+	setList("ALLOW_ORIGINS", &c.AllowOrigins)
+	if s := os.Getenv("ICE_SERVERS"); s != "" {
+		servers, err := parseICEServers(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ICE_SERVERS: %w", err))
+		}
+		c.ICEServers = servers
+	}
+	return errors.Join(errs...)
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (s *sourceConfig) inherit(parent *sourceConfig) {
+	if s.MediaFile == "" && s.AudioFile == "" && s.VideoFile == "" {
+		s.MediaFile = parent.MediaFile
+		s.AudioFile = parent.AudioFile
+		s.VideoFile = parent.VideoFile
+		s.H265File = parent.H265File
+		s.IVFFiles = parent.IVFFiles
+		s.Bitrate = parent.Bitrate
+		s.Renditions = parent.Renditions
+	}
+	if s.OggPageDuration == 0 {
+		s.OggPageDuration = parent.OggPageDuration
+	}
+	if s.H264FrameDuration == 0 {
+		s.H264FrameDuration = parent.H264FrameDuration
+	}
+	if s.Loop == nil {
+		s.Loop = parent.Loop
+	}
+}
+
+func (c *config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.HTTPAddr); err != nil {
+		errs = append(errs, fmt.Errorf("http_addr: %w", err))
+	}
+	for _, candidate := range c.Candidates {
+		if net.ParseIP(candidate) == nil {
+			errs = append(errs, fmt.Errorf("candidates: %q is not an IP", candidate))
+		}
+	}
+	if c.ICEUDPPort < 0 || c.ICEUDPPort > 65535 {
+		errs = append(errs, fmt.Errorf("ice_udp_port: %d out of range", c.ICEUDPPort))
+	}
+	if c.ICETCPPort < 0 || c.ICETCPPort > 65535 {
+		errs = append(errs, fmt.Errorf("ice_tcp_port: %d out of range", c.ICETCPPort))
+	}
+	errs = append(errs, c.Source.validate("source")...)
+	names := make([]string, 0, len(c.Paths))
+	for name := range c.Paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		source := c.Paths[name]
+		if !strings.HasPrefix(name, "/") || streamName(name) != name {
+			errs = append(errs, fmt.Errorf("paths: %q is not a stream name such as /live/livestream", name))
+		}
+		if source == nil {
+			errs = append(errs, fmt.Errorf("paths %s: empty", name))
+			continue
+		}
+		errs = append(errs, source.validate("paths "+name)...)
+	}
+	errs = append(errs, validateCodecs(c.Codecs.Audio, c.Codecs.Video)...)
+	errs = append(errs, c.Interceptors.validate()...)
+	errs = append(errs, c.GOPCache.validate()...)
+	errs = append(errs, c.Admission.validate()...)
+	if c.ConnectTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("connect_timeout must be positive"))
+	}
+	if c.ICEDisconnectedTimeout <= 0 || c.ICEFailedTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("ice_disconnected_timeout and ice_failed_timeout must be positive"))
+	}
+	for name, p := range c.Profiles {
+		if err := p.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("profiles %s: %w", name, err))
+		}
+	}
+	if _, ok := c.profiles()[c.DefaultProfile]; !ok {
+		errs = append(errs, fmt.Errorf("default_profile: %q not exist", c.DefaultProfile))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *sourceConfig) validate(name string) []error {
+	var errs []error
+	if s.MediaFile == "" && (s.AudioFile == "" || s.VideoFile == "") {
+		errs = append(errs, fmt.Errorf("%s: media_file or both audio_file and video_file required", name))
+	}
+	if s.OggPageDuration <= 0 {
+		errs = append(errs, fmt.Errorf("%s: ogg_page_duration must be positive", name))
+	}
+	if s.H264FrameDuration <= 0 {
+		errs = append(errs, fmt.Errorf("%s: h264_frame_duration must be positive", name))
+	}
+	if len(s.Renditions) > 0 && s.Bitrate <= 0 {
+		errs = append(errs, fmt.Errorf("%s: bitrate required with renditions", name))
+	}
+	names := map[string]bool{MAIN_RENDITION: true}
+	for _, r := range s.Renditions {
+		if r.Name == "" || names[r.Name] {
+			errs = append(errs, fmt.Errorf("%s: rendition name %q empty or used twice", name, r.Name))
+		}
+		names[r.Name] = true
+		if (r.MediaFile == "") == (r.VideoFile == "") {
+			errs = append(errs, fmt.Errorf("%s: rendition %s needs one of media_file and video_file", name, r.Name))
+		}
+		if r.Bitrate <= 0 {
+			errs = append(errs, fmt.Errorf("%s: rendition %s bitrate must be positive", name, r.Name))
+		}
+	}
+	return errs
+}
+
+// sourceConfig is the source playing the rendition, with the timing and
+// loop of the source it belongs to.
+func (r *renditionConfig) sourceConfig(parent *sourceConfig) *sourceConfig {
+	return &sourceConfig{
+		MediaFile:         r.MediaFile,
+		VideoFile:         r.VideoFile,
+		OggPageDuration:   parent.OggPageDuration,
+		H264FrameDuration: parent.H264FrameDuration,
+		Loop:              parent.Loop,
+	}
+}
+
+// renditions lists the main video and the renditions in ascending bitrate,
+// nil without renditions.
+func (s *sourceConfig) renditions() []rendition {
+	if len(s.Renditions) == 0 {
+		return nil
+	}
+	renditions := []rendition{{name: MAIN_RENDITION, bitrate: s.Bitrate}}
+	for _, r := range s.Renditions {
+		renditions = append(renditions, rendition{name: r.Name, bitrate: r.Bitrate})
+	}
+	sort.SliceStable(renditions, func(i, j int) bool {
+		return renditions[i].bitrate < renditions[j].bitrate
+	})
+	return renditions
+}
+
+// validateCodecs checks the payload types are unique among both kinds and
+// that every rtx apt names a payload type of the list.
+func validateCodecs(audio, video []codecConfig) []error {
+	var errs []error
+	payloadTypes := make(map[uint8]bool)
+	for _, kind := range []struct {
+		name   string
+		codecs []codecConfig
+	}{{"audio", audio}, {"video", video}} {
+		for _, codec := range kind.codecs {
+			if !strings.HasPrefix(strings.ToLower(codec.MimeType), kind.name+"/") {
+				errs = append(errs, fmt.Errorf("codecs %s: mime_type %q is not %s/*", kind.name, codec.MimeType, kind.name))
+			}
+			if codec.ClockRate == 0 {
+				errs = append(errs, fmt.Errorf("codecs %s: %s clock_rate required", kind.name, codec.MimeType))
+			}
+			if codec.PayloadType > 127 {
+				errs = append(errs, fmt.Errorf("codecs %s: %s payload_type %d above 127", kind.name, codec.MimeType, codec.PayloadType))
+			}
+			if payloadTypes[codec.PayloadType] {
+				errs = append(errs, fmt.Errorf("codecs %s: payload_type %d used twice", kind.name, codec.PayloadType))
+			}
+			payloadTypes[codec.PayloadType] = true
+		}
+	}
+	for _, codec := range video {
+		if !strings.EqualFold(codec.MimeType, "video/rtx") {
+			continue
+		}
+		apt, err := strconv.Atoi(strings.TrimPrefix(codec.Fmtp, "apt="))
+		if err != nil || apt < 0 || apt > 127 || !payloadTypes[uint8(apt)] {
+			errs = append(errs, fmt.Errorf("codecs video: rtx %d fmtp %q is not apt=<payload type>", codec.PayloadType, codec.Fmtp))
+		}
+	}
+	return errs
+}
+
+func (i *interceptorConfig) validate() []error {
+	var errs []error
+	// the sizes accepted by pion's receive log and send buffer
+	if !isPowerOfTwo(i.NACKGeneratorSize) || i.NACKGeneratorSize < 64 {
+		errs = append(errs, fmt.Errorf("interceptors: nack_generator_size %d is not a power of two from 64 to 32768", i.NACKGeneratorSize))
+	}
+	if !isPowerOfTwo(i.NACKResponderSize) {
+		errs = append(errs, fmt.Errorf("interceptors: nack_responder_size %d is not a power of two up to 32768", i.NACKResponderSize))
+	}
+	if i.GCCInitialBitrate <= 0 {
+		errs = append(errs, errors.New("interceptors: gcc_initial_bitrate must be positive"))
+	}
+	if i.NACKGeneratorInterval <= 0 {
+		errs = append(errs, errors.New("interceptors: nack_generator_interval must be positive"))
+	}
+	// the playout delay extension carries 12 bit values of 10ms
+	if i.PlayoutDelayMin < 0 || i.PlayoutDelayMin > i.PlayoutDelayMax || i.PlayoutDelayMax > 40950*time.Millisecond {
+		errs = append(errs, fmt.Errorf("interceptors: playout delay %v-%v not within 0-40.95s", i.PlayoutDelayMin, i.PlayoutDelayMax))
+	}
+	return errs
+}
+
+func isPowerOfTwo(n uint16) bool {
+	return n != 0 && n&(n-1) == 0
+}
+
+// rtpCodecs returns the configured codecs, or the defaults when the list
+// is empty.
+func rtpCodecs(codecs []codecConfig, defaults []webrtc.RTPCodecParameters) []webrtc.RTPCodecParameters {
+	if len(codecs) == 0 {
+		return defaults
+	}
+	var parameters []webrtc.RTPCodecParameters
+	for _, codec := range codecs {
+		parameters = append(parameters, webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    codec.MimeType,
+				ClockRate:   codec.ClockRate,
+				Channels:    codec.Channels,
+				SDPFmtpLine: codec.Fmtp,
+			},
+			PayloadType: webrtc.PayloadType(codec.PayloadType),
+		})
+	}
+	return parameters
+}
+
+// tokenValidators builds the token sources of the auth settings.
+func (c *config) tokenValidators() []tokenValidator {
+	var validators []tokenValidator
+	if len(c.Auth.Tokens) > 0 {
+		validators = append(validators, newStaticTokenValidator(c.Auth.Tokens))
+	}
+	if c.Auth.HMACSecret != "" {
+		validators = append(validators, newHMACTokenValidator(c.Auth.HMACSecret))
+	}
+	return validators
+}
+
+// profiles returns the built-in profiles with the ones of the file added,
+// a profile of the file replaces the built-in one of the same name.
+func (c *config) profiles() map[string]profile {
+	profiles := make(map[string]profile)
+	for name, p := range defaultProfiles {
+		profiles[name] = p
+	}
+	for name, p := range c.Profiles {
+		profiles[name] = p
+	}
+	return profiles
+}
@@ -0,0 +1,346 @@
+package whep
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// h264AccessUnit is the NALs of one picture, they share an RTP timestamp.
+type h264AccessUnit struct {
+	nals []*h264reader.NAL
+	idr  bool
+}
+
+// Data joins the NALs with Annex-B start codes, the H264 payloader splits
+// them again into single NAL, STAP-A or FU-A packets.
+func (au *h264AccessUnit) Data() []byte {
+	var data []byte
+	for _, nal := range au.nals {
+		data = append(data, annexBStartCode...)
+		data = append(data, nal.Data...)
+	}
+	return data
+}
+
+// avcConfig is the NAL length size and the SPS/PPS of an
+// AVCDecoderConfigurationRecord (ISO/IEC 14496-15), the avcC box of MP4 and
+// the CodecPrivate of Matroska.
+type avcConfig struct {
+	lengthSize    int
+	parameterSets [][]byte
+}
+
+func parseAVCConfig(record []byte) (*avcConfig, error) {
+	errInvalid := errors.New("avc decoder configuration invalid")
+	if len(record) < 6 {
+		return nil, errInvalid
+	}
+	config := &avcConfig{lengthSize: int(record[4]&0x03) + 1}
+	count := int(record[5] & 0x1f)
+	record = record[6:]
+	for i := 0; i < 2; i++ {
+		for ; count > 0; count-- {
+			if len(record) < 2 {
+				return nil, errInvalid
+			}
+			size := int(record[0])<<8 | int(record[1])
+			if len(record) < 2+size {
+				return nil, errInvalid
+			}
+			config.parameterSets = append(config.parameterSets, record[2:2+size])
+			record = record[2+size:]
+		}
+		// the SPS list is followed by the PPS list
+		if i == 0 {
+			if len(record) < 1 {
+				return nil, errInvalid
+			}
+			count = int(record[0])
+			record = record[1:]
+		}
+	}
+	return config, nil
+}
+
+// annexB converts a length prefixed AVC sample to Annex-B, sync samples
+// are prefixed with the SPS/PPS of the configuration since the samples
+// rarely carry them.
+func (c *avcConfig) annexB(sample []byte, sync bool) ([]byte, error) {
+	var data []byte
+	if sync {
+		for _, ps := range c.parameterSets {
+			data = append(data, annexBStartCode...)
+			data = append(data, ps...)
+		}
+	}
+	for len(sample) > 0 {
+		if len(sample) < c.lengthSize {
+			return nil, errors.New("avc sample truncated")
+		}
+		var size int
+		for _, b := range sample[:c.lengthSize] {
+			size = size<<8 | int(b)
+		}
+		sample = sample[c.lengthSize:]
+		if size > len(sample) {
+			return nil, errors.New("avc nal truncated")
+		}
+		data = append(data, annexBStartCode...)
+		data = append(data, sample[:size]...)
+		sample = sample[size:]
+	}
+	return data, nil
+}
+
+// h264AccessUnitReader groups the NALs of an Annex-B stream into access
+// units following the boundary rules of H.264 7.4.1.2.3, and keeps the frame
+// duration of the VUI timing info of the latest SPS.
+type h264AccessUnitReader struct {
+	reader        *h264reader.H264Reader
+	pending       *h264reader.NAL
+	frameDuration time.Duration
+}
+
+func newH264AccessUnitReader(in io.Reader) (*h264AccessUnitReader, error) {
+	reader, err := h264reader.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	return &h264AccessUnitReader{reader: reader}, nil
+}
+
+// FrameDuration is zero until an SPS with timing info is read.
+func (r *h264AccessUnitReader) FrameDuration() time.Duration {
+	return r.frameDuration
+}
+
+func (r *h264AccessUnitReader) NextAccessUnit() (*h264AccessUnit, error) {
+	au := &h264AccessUnit{}
+	hasVCL := false
+	for {
+		nal := r.pending
+		r.pending = nil
+		if nal == nil {
+			var err error
+			if nal, err = r.reader.NextNAL(); err != nil {
+				if err == io.EOF && len(au.nals) > 0 {
+					return au, nil
+				}
+				return nil, err
+			}
+		}
+		if len(nal.Data) == 0 {
+			continue
+		}
+		if hasVCL && startsAccessUnit(nal) {
+			r.pending = nal
+			return au, nil
+		}
+		switch nal.UnitType {
+		case h264reader.NalUnitTypeCodedSliceIdr:
+			au.idr = true
+		case h264reader.NalUnitTypeSPS:
+			if d, err := parseSPSFrameDuration(nal.Data); err == nil && d > 0 && d < time.Second {
+				r.frameDuration = d
+			}
+		}
+		if isVCL(nal.UnitType) {
+			hasVCL = true
+		}
+		au.nals = append(au.nals, nal)
+	}
+}
+
+func isVCL(t h264reader.NalUnitType) bool {
+	return t >= h264reader.NalUnitTypeCodedSliceNonIdr && t <= h264reader.NalUnitTypeCodedSliceIdr
+}
+
+// startsAccessUnit reports whether nal opens a new access unit once the
+// current one already has a slice: AUD, SEI, SPS, PPS, prefix and reserved
+// NALs, or the first slice of a picture (first_mb_in_slice is 0).
+func startsAccessUnit(nal *h264reader.NAL) bool {
+	switch t := nal.UnitType; {
+	case t == h264reader.NalUnitTypeCodedSliceNonIdr, t == h264reader.NalUnitTypeCodedSliceDataPartitionA,
+		t == h264reader.NalUnitTypeCodedSliceIdr:
+		return len(nal.Data) > 1 && nal.Data[1]&0x80 != 0
+	case t == h264reader.NalUnitTypeSEI, t == h264reader.NalUnitTypeSPS,
+		t == h264reader.NalUnitTypePPS, t == h264reader.NalUnitTypeAUD:
+		return true
+	case t >= 14 && t <= 18:
+		return true
+	}
+	return false
+}
+
+// parseSPSFrameDuration reads the SPS up to the VUI timing info, a frame
+// lasts two ticks since a tick is a field.
+func parseSPSFrameDuration(sps []byte) (time.Duration, error) {
+	b := &bitReader{data: unescapeRBSP(sps[1:])}
+	profileIdc := b.u(8)
+	b.skip(16) // constraint flags, level_idc
+	b.ue()     // seq_parameter_set_id
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc := b.ue()
+		if chromaFormatIdc == 3 {
+			b.skip(1) // separate_colour_plane_flag
+		}
+		b.ue()    // bit_depth_luma_minus8
+		b.ue()    // bit_depth_chroma_minus8
+		b.skip(1) // qpprime_y_zero_transform_bypass_flag
+		if b.u(1) == 1 {
+			lists := 8
+			if chromaFormatIdc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if b.u(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				lastScale, nextScale := 8, 8
+				for j := 0; j < size; j++ {
+					if nextScale != 0 {
+						nextScale = (lastScale + b.se() + 256) % 256
+					}
+					if nextScale != 0 {
+						lastScale = nextScale
+					}
+				}
+			}
+		}
+	}
+	b.ue() // log2_max_frame_num_minus4
+	switch b.ue() {
+	case 0:
+		b.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		b.skip(1) // delta_pic_order_always_zero_flag
+		b.se()    // offset_for_non_ref_pic
+		b.se()    // offset_for_top_to_bottom_field
+		for n := b.ue(); n > 0 && b.err == nil; n-- {
+			b.se() // offset_for_ref_frame
+		}
+	}
+	b.ue()    // max_num_ref_frames
+	b.skip(1) // gaps_in_frame_num_value_allowed_flag
+	b.ue()    // pic_width_in_mbs_minus1
+	b.ue()    // pic_height_in_map_units_minus1
+	if b.u(1) == 0 {
+		b.skip(1) // mb_adaptive_frame_field_flag
+	}
+	b.skip(1) // direct_8x8_inference_flag
+	if b.u(1) == 1 {
+		b.ue() // frame_crop_left_offset
+		b.ue() // frame_crop_right_offset
+		b.ue() // frame_crop_top_offset
+		b.ue() // frame_crop_bottom_offset
+	}
+	if b.u(1) == 0 {
+		return 0, b.err
+	}
+	if b.u(1) == 1 && b.u(8) == 255 {
+		b.skip(32) // sar_width, sar_height
+	}
+	if b.u(1) == 1 {
+		b.skip(1) // overscan_appropriate_flag
+	}
+	if b.u(1) == 1 {
+		b.skip(4) // video_format, video_full_range_flag
+		if b.u(1) == 1 {
+			b.skip(24) // colour_primaries, transfer_characteristics, matrix_coefficients
+		}
+	}
+	if b.u(1) == 1 {
+		b.ue() // chroma_sample_loc_type_top_field
+		b.ue() // chroma_sample_loc_type_bottom_field
+	}
+	if b.u(1) == 0 {
+		return 0, b.err
+	}
+	numUnitsInTick := b.u(32)
+	timeScale := b.u(32)
+	if b.err != nil {
+		return 0, b.err
+	}
+	if numUnitsInTick == 0 || timeScale == 0 {
+		return 0, errors.New("sps timing info invalid")
+	}
+	return time.Duration(uint64(time.Second) * 2 * uint64(numUnitsInTick) / uint64(timeScale)), nil
+}
+
+// unescapeRBSP drops the emulation prevention bytes of 00 00 03 sequences.
+func unescapeRBSP(data []byte) []byte {
+	rbsp := make([]byte, 0, len(data))
+	zeros := 0
+	for _, c := range data {
+		if zeros >= 2 && c == 0x03 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, c)
+	}
+	return rbsp
+}
+
+// bitReader reads the bit fields of an RBSP, the first read past the end
+// sets err and every later read returns zero.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (b *bitReader) u(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if b.pos >= len(b.data)*8 {
+			b.err = io.ErrUnexpectedEOF
+			return 0
+		}
+		bit := (b.data[b.pos/8] >> (7 - uint(b.pos%8))) & 1
+		v = v<<1 | uint32(bit)
+		b.pos++
+	}
+	return v
+}
+
+func (b *bitReader) skip(n int) {
+	for ; n > 32; n -= 32 {
+		b.u(32)
+	}
+	b.u(n)
+}
+
+func (b *bitReader) ue() uint32 {
+	leadingZeros := 0
+	for b.u(1) == 0 && b.err == nil {
+		leadingZeros++
+		if leadingZeros > 31 {
+			b.err = errors.New("exp-golomb code too long")
+			return 0
+		}
+	}
+	return 1<<uint(leadingZeros) - 1 + b.u(leadingZeros)
+}
+
+func (b *bitReader) se() int {
+	v := b.ue()
+	if v%2 == 1 {
+		return int(v/2) + 1
+	}
+	return -int(v / 2)
+}
@@ -0,0 +1,216 @@
+package whep
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+// testBits packs a string of 0 and 1, spaces aside, into bytes padded with
+// zero bits.
+func testBits(bits string) []byte {
+	bits = strings.ReplaceAll(bits, " ", "")
+	data := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit == '1' {
+			data[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return data
+}
+
+// testEscapeRBSP inserts the emulation prevention bytes an encoder writes.
+func testEscapeRBSP(rbsp []byte) []byte {
+	var data []byte
+	zeros := 0
+	for _, c := range rbsp {
+		if zeros >= 2 && c <= 0x03 {
+			data = append(data, 0x03)
+			zeros = 0
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		data = append(data, c)
+	}
+	return data
+}
+
+func TestUnescapeRBSP(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		rbsp []byte
+	}{
+		{"none", []byte{0x42, 0x00, 0x1e}, []byte{0x42, 0x00, 0x1e}},
+		{"start code", []byte{0x00, 0x00, 0x03, 0x01}, []byte{0x00, 0x00, 0x01}},
+		{"escaped 03", []byte{0x00, 0x00, 0x03, 0x03}, []byte{0x00, 0x00, 0x03}},
+		{"two in a row", []byte{0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00}, []byte{0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"single zero", []byte{0x00, 0x03, 0x01}, []byte{0x00, 0x03, 0x01}},
+		{"at the end", []byte{0x11, 0x00, 0x00, 0x03}, []byte{0x11, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		if rbsp := unescapeRBSP(tt.data); !bytes.Equal(rbsp, tt.rbsp) {
+			t.Errorf("%s: % x, want % x", tt.name, rbsp, tt.rbsp)
+		}
+	}
+}
+
+func TestParseSPSFrameDuration(t *testing.T) {
+	// baseline 3.0, 16x16, frame_mbs_only, no cropping
+	const head = "01000010 11000000 00011110 1 1 011 010 0 1 1 1 1 0"
+	// VUI with only the timing info, 1/50 per tick is 25 frames per second
+	const timing = "1 0 0 0 0 1 " +
+		"00000000 00000000 00000000 00000001 " +
+		"00000000 00000000 00000000 00110010 1"
+	tests := []struct {
+		name     string
+		sps      []byte
+		duration time.Duration
+		err      bool
+	}{
+		{"timing info", append([]byte{0x67}, testEscapeRBSP(testBits(head+timing))...), 40 * time.Millisecond, false},
+		{"no vui", append([]byte{0x67}, testBits(head+"0 1")...), 0, false},
+		{"no timing info", append([]byte{0x67}, testBits(head+"1 0 0 0 0 0 1")...), 0, false},
+		{"zero time scale", append([]byte{0x67}, testEscapeRBSP(testBits(head+"1 0 0 0 0 1 "+
+			"00000000 00000000 00000000 00000001 00000000 00000000 00000000 00000000 1"))...), 0, true},
+		{"truncated", append([]byte{0x67}, testBits(head+"1 0 0 0 0 1 00000000")...), 0, true},
+		{"empty", []byte{0x67}, 0, true},
+	}
+	for _, tt := range tests {
+		duration, err := parseSPSFrameDuration(tt.sps)
+		if (err != nil) != tt.err || duration != tt.duration {
+			t.Errorf("%s: %v %v, want %v error %v", tt.name, duration, err, tt.duration, tt.err)
+		}
+	}
+}
+
+func TestH264AccessUnitReader(t *testing.T) {
+	var (
+		aud   = []byte{0x09, 0xf0}
+		sps   = []byte{0x67, 0x42, 0xc0, 0x1e, 0xd9}
+		pps   = []byte{0x68, 0xce, 0x3c, 0x80}
+		idr   = []byte{0x65, 0x88, 0x84}
+		p     = []byte{0x41, 0x9a, 0x02}
+		slice = []byte{0x41, 0x40, 0x04} // first_mb_in_slice 1
+	)
+	tests := []struct {
+		name string
+		nals [][]byte
+		// the NAL types of every access unit, and which are IDR
+		types [][]h264reader.NalUnitType
+		idrs  []bool
+	}{
+		{
+			name:  "parameter sets go with the idr",
+			nals:  [][]byte{sps, pps, idr, p, p},
+			types: [][]h264reader.NalUnitType{{7, 8, 5}, {1}, {1}},
+			idrs:  []bool{true, false, false},
+		},
+		{
+			name:  "slices of one picture",
+			nals:  [][]byte{idr, slice, p, slice},
+			types: [][]h264reader.NalUnitType{{5, 1}, {1, 1}},
+			idrs:  []bool{true, false},
+		},
+		{
+			name:  "aud opens the access unit",
+			nals:  [][]byte{aud, idr, aud, p},
+			types: [][]h264reader.NalUnitType{{9, 5}, {9, 1}},
+			idrs:  []bool{true, false},
+		},
+		{
+			name:  "parameter sets alone",
+			nals:  [][]byte{sps, pps},
+			types: [][]h264reader.NalUnitType{{7, 8}},
+			idrs:  []bool{false},
+		},
+	}
+	for _, tt := range tests {
+		var data []byte
+		for _, nal := range tt.nals {
+			data = append(data, annexBStartCode...)
+			data = append(data, nal...)
+		}
+		reader, err := newH264AccessUnitReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var types [][]h264reader.NalUnitType
+		var idrs []bool
+		for {
+			au, err := reader.NextAccessUnit()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			var auTypes []h264reader.NalUnitType
+			for _, nal := range au.nals {
+				auTypes = append(auTypes, nal.UnitType)
+			}
+			types = append(types, auTypes)
+			idrs = append(idrs, au.idr)
+		}
+		if !reflect.DeepEqual(types, tt.types) || !reflect.DeepEqual(idrs, tt.idrs) {
+			t.Errorf("%s: %v %v, want %v %v", tt.name, types, idrs, tt.types, tt.idrs)
+		}
+	}
+}
+
+func TestAVCConfigAnnexB(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e}
+	pps := []byte{0x68, 0xce}
+	// version, profile, compatibility, level, 4 byte lengths, 1 SPS, 1 PPS
+	record := []byte{0x01, 0x42, 0xc0, 0x1e, 0xff, 0xe1, 0x00, 0x04}
+	record = append(record, sps...)
+	record = append(record, 0x01, 0x00, 0x02)
+	record = append(record, pps...)
+	config, err := parseAVCConfig(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.lengthSize != 4 || !reflect.DeepEqual(config.parameterSets, [][]byte{sps, pps}) {
+		t.Fatalf("config %d %x", config.lengthSize, config.parameterSets)
+	}
+	for _, n := range []int{0, 5, 7, len(record) - 1} {
+		if _, err := parseAVCConfig(record[:n]); err == nil {
+			t.Errorf("record truncated to %d bytes parsed", n)
+		}
+	}
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	idr := []byte{0x65, 0x88}
+	p := []byte{0x41, 0x9a, 0x02}
+	tests := []struct {
+		name   string
+		sample []byte
+		sync   bool
+		data   []byte
+		err    bool
+	}{
+		{"sync sample", join([]byte{0, 0, 0, 2}, idr), true,
+			join(annexBStartCode, sps, annexBStartCode, pps, annexBStartCode, idr), false},
+		{"two nals", join([]byte{0, 0, 0, 2}, idr, []byte{0, 0, 0, 3}, p), false,
+			join(annexBStartCode, idr, annexBStartCode, p), false},
+		{"empty nal", []byte{0, 0, 0, 0}, false, annexBStartCode, false},
+		{"truncated length", []byte{0, 0, 0}, false, nil, true},
+		{"truncated nal", join([]byte{0, 0, 0, 3}, idr), false, nil, true},
+	}
+	for _, tt := range tests {
+		data, err := config.annexB(tt.sample, tt.sync)
+		if (err != nil) != tt.err || !bytes.Equal(data, tt.data) {
+			t.Errorf("%s: % x %v, want % x error %v", tt.name, data, err, tt.data, tt.err)
+		}
+	}
+}
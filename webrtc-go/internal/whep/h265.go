@@ -0,0 +1,444 @@
+package whep
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	H265_NALU_TYPE_VPS        = 32
+	H265_NALU_TYPE_AUD        = 35
+	H265_NALU_TYPE_PREFIX_SEI = 39
+	H265_NALU_TYPE_AP         = 48
+	H265_NALU_TYPE_FU         = 49
+	H265_NALU_HEADER_SIZE     = 2
+	H265_FU_HEADER_SIZE       = 1
+	H265_AP_NALU_LENGTH_SIZE  = 2
+	H265_RTP_OUTBOUND_MTU     = 1200
+)
+
+// h265Source plays an H265 Annex-B file as a rendition of the video, paced
+// by access unit like the H264 file.
+type h265Source struct {
+	fileName string
+	// frameDuration is the H264FrameDuration of the source when the VPS has
+	// no timing info, the rendition is the same video at the same frame rate
+	frameDuration time.Duration
+	loop          bool
+}
+
+func (h *h265Source) VideoMimeTypes() []string {
+	return []string{webrtc.MimeTypeH265}
+}
+
+// Run plays the file in passes on a clock of the group, so the rendition
+// wraps together with the audio of the stream.
+func (h *h265Source) Run(ctx context.Context, s sampleWriter, group *mediaClockGroup) {
+	clocks := group.NewClocks(1)
+	defer group.Leave(clocks)
+	for {
+		err := h.play(ctx, s, clocks[0])
+		if err != io.EOF {
+			if err != context.Canceled {
+				log.Println(err)
+			}
+			return
+		}
+		if !h.loop || group.Rewind(ctx) != nil {
+			return
+		}
+		log.Println("Rewind Stream H265:", s.Name())
+	}
+}
+
+func (h *h265Source) play(ctx context.Context, s sampleWriter, clock *mediaClock) error {
+	file, err := os.Open(h.fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := newH265AccessUnitReader(file)
+	started := false
+	for {
+		au, err := reader.NextAccessUnit()
+		if err != nil {
+			return err
+		}
+		// the decoder can only start at an IRAP picture
+		if !started && !au.irap {
+			continue
+		}
+		started = true
+		frameDuration := reader.FrameDuration()
+		if frameDuration == 0 {
+			frameDuration = h.frameDuration
+		}
+		sample := media.Sample{Data: au.Data(), Duration: frameDuration}
+		clock.Skip(&sample)
+		s.WriteSample(webrtc.MimeTypeH265, sample)
+		if err := clock.Wait(ctx, frameDuration); err != nil {
+			return err
+		}
+	}
+}
+
+// annexBReader splits an Annex-B byte stream on its 3 or 4 byte start
+// codes, unlike h264reader it does not look at the NAL header.
+type annexBReader struct {
+	reader  *bufio.Reader
+	started bool
+}
+
+func newAnnexBReader(in io.Reader) *annexBReader {
+	return &annexBReader{reader: bufio.NewReader(in)}
+}
+
+func (r *annexBReader) NextNAL() ([]byte, error) {
+	var nal []byte
+	zeros := 0
+	for {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			if err == io.EOF && r.started && len(nal) > zeros {
+				return nal[:len(nal)-zeros], nil
+			}
+			return nil, err
+		}
+		if b == 0x01 && zeros >= 2 {
+			nal = nal[:len(nal)-zeros]
+			if r.started && len(nal) > 0 {
+				return nal, nil
+			}
+			r.started = true
+			nal, zeros = nil, 0
+			continue
+		}
+		if b == 0x00 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		nal = append(nal, b)
+	}
+}
+
+func h265NALType(nal []byte) uint8 {
+	return (nal[0] >> 1) & 0x3f
+}
+
+// h265AccessUnit is the NALs of one picture, they share an RTP timestamp.
+type h265AccessUnit struct {
+	nals [][]byte
+	irap bool
+}
+
+func (au *h265AccessUnit) Data() []byte {
+	var data []byte
+	for _, nal := range au.nals {
+		data = append(data, annexBStartCode...)
+		data = append(data, nal...)
+	}
+	return data
+}
+
+// h265AccessUnitReader groups the NALs of an Annex-B stream into access
+// units following H.265 7.4.2.4.4, and keeps the frame duration of the
+// timing info of the latest VPS.
+type h265AccessUnitReader struct {
+	reader        *annexBReader
+	pending       []byte
+	frameDuration time.Duration
+}
+
+func newH265AccessUnitReader(in io.Reader) *h265AccessUnitReader {
+	return &h265AccessUnitReader{reader: newAnnexBReader(in)}
+}
+
+// FrameDuration is zero until a VPS with timing info is read.
+func (r *h265AccessUnitReader) FrameDuration() time.Duration {
+	return r.frameDuration
+}
+
+func (r *h265AccessUnitReader) NextAccessUnit() (*h265AccessUnit, error) {
+	au := &h265AccessUnit{}
+	hasVCL := false
+	for {
+		nal := r.pending
+		r.pending = nil
+		if nal == nil {
+			var err error
+			if nal, err = r.reader.NextNAL(); err != nil {
+				if err == io.EOF && len(au.nals) > 0 {
+					return au, nil
+				}
+				return nil, err
+			}
+		}
+		if len(nal) < H265_NALU_HEADER_SIZE {
+			continue
+		}
+		if hasVCL && h265StartsAccessUnit(nal) {
+			r.pending = nal
+			return au, nil
+		}
+		switch t := h265NALType(nal); {
+		case t < 32:
+			hasVCL = true
+			// BLA, IDR and CRA pictures
+			if t >= 16 && t <= 23 {
+				au.irap = true
+			}
+		case t == H265_NALU_TYPE_VPS:
+			if d, err := parseVPSFrameDuration(nal); err == nil && d > 0 && d < time.Second {
+				r.frameDuration = d
+			}
+		}
+		au.nals = append(au.nals, nal)
+	}
+}
+
+// h265StartsAccessUnit reports whether nal opens a new access unit once the
+// current one already has a slice: VPS, SPS, PPS, AUD, prefix SEI, reserved
+// and unspecified NALs, or the first slice segment of a picture.
+func h265StartsAccessUnit(nal []byte) bool {
+	switch t := h265NALType(nal); {
+	case t < 32:
+		return len(nal) > H265_NALU_HEADER_SIZE && nal[2]&0x80 != 0
+	case t >= H265_NALU_TYPE_VPS && t <= H265_NALU_TYPE_AUD, t == H265_NALU_TYPE_PREFIX_SEI:
+		return true
+	case t >= 41 && t <= 44, t >= 48 && t <= 55:
+		return true
+	}
+	return false
+}
+
+// parseVPSFrameDuration reads the VPS up to vps_timing_info, an H265 tick
+// is a picture.
+func parseVPSFrameDuration(vps []byte) (time.Duration, error) {
+	b := &bitReader{data: unescapeRBSP(vps[H265_NALU_HEADER_SIZE:])}
+	b.skip(4 + 1 + 1 + 6) // vps_video_parameter_set_id, base layer flags, vps_max_layers_minus1
+	maxSubLayersMinus1 := int(b.u(3))
+	b.skip(1 + 16) // vps_temporal_id_nesting_flag, vps_reserved_0xffff_16bits
+	skipProfileTierLevel(b, maxSubLayersMinus1)
+	orderingInfoPresent := b.u(1) == 1
+	for i := 0; i <= maxSubLayersMinus1; i++ {
+		if i > 0 && !orderingInfoPresent {
+			break
+		}
+		b.ue() // vps_max_dec_pic_buffering_minus1
+		b.ue() // vps_max_num_reorder_pics
+		b.ue() // vps_max_latency_increase_plus1
+	}
+	maxLayerID := int(b.u(6))
+	numLayerSetsMinus1 := int(b.ue())
+	if numLayerSetsMinus1 > 1023 {
+		return 0, errors.New("vps layer sets invalid")
+	}
+	b.skip(numLayerSetsMinus1 * (maxLayerID + 1)) // layer_id_included_flag
+	if b.u(1) == 0 {
+		return 0, b.err
+	}
+	numUnitsInTick := b.u(32)
+	timeScale := b.u(32)
+	if b.err != nil {
+		return 0, b.err
+	}
+	if numUnitsInTick == 0 || timeScale == 0 {
+		return 0, errors.New("vps timing info invalid")
+	}
+	return time.Duration(uint64(time.Second) * uint64(numUnitsInTick) / uint64(timeScale)), nil
+}
+
+// skipProfileTierLevel skips profile_tier_level(1, maxSubLayersMinus1).
+func skipProfileTierLevel(b *bitReader, maxSubLayersMinus1 int) {
+	b.skip(88) // general profile space, tier, profile idc, compatibility and constraint flags
+	b.skip(8)  // general_level_idc
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		profilePresent[i] = b.u(1) == 1
+		levelPresent[i] = b.u(1) == 1
+	}
+	if maxSubLayersMinus1 > 0 {
+		b.skip(2 * (8 - maxSubLayersMinus1)) // reserved_zero_2bits
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] {
+			b.skip(88)
+		}
+		if levelPresent[i] {
+			b.skip(8)
+		}
+	}
+}
+
+// h265Payloader packetizes an Annex-B access unit following RFC 7798, NALs
+// that fit the MTU are sent alone or aggregated in APs, larger ones are
+// split in FUs. DONL is never sent since sprop-max-don-diff is 0.
+type h265Payloader struct{}
+
+func (p *h265Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	var payloads [][]byte
+	var aggregated [][]byte
+	aggregatedSize := H265_NALU_HEADER_SIZE
+	flush := func() {
+		switch len(aggregated) {
+		case 0:
+		case 1:
+			payloads = append(payloads, aggregated[0])
+		default:
+			payloads = append(payloads, h265AggregationPacket(aggregated))
+		}
+		aggregated, aggregatedSize = nil, H265_NALU_HEADER_SIZE
+	}
+	reader := newAnnexBReader(bytes.NewReader(payload))
+	for {
+		nal, err := reader.NextNAL()
+		if err != nil {
+			break
+		}
+		if len(nal) < H265_NALU_HEADER_SIZE {
+			continue
+		}
+		if len(nal) > int(mtu) {
+			flush()
+			payloads = append(payloads, h265FragmentationUnits(mtu, nal)...)
+			continue
+		}
+		if aggregatedSize+H265_AP_NALU_LENGTH_SIZE+len(nal) > int(mtu) {
+			flush()
+		}
+		aggregated = append(aggregated, nal)
+		aggregatedSize += H265_AP_NALU_LENGTH_SIZE + len(nal)
+	}
+	flush()
+	return payloads
+}
+
+// h265AggregationPacket builds an AP (RFC 7798 4.4.2), its header takes the
+// F bit of any unit and the lowest LayerId and TID of the units.
+func h265AggregationPacket(nals [][]byte) []byte {
+	forbidden := byte(0)
+	layerID := byte(0x3f)
+	tid := byte(0x07)
+	for _, nal := range nals {
+		forbidden |= nal[0] & 0x80
+		if l := (nal[0]&0x01)<<5 | nal[1]>>3; l < layerID {
+			layerID = l
+		}
+		if t := nal[1] & 0x07; t < tid {
+			tid = t
+		}
+	}
+	packet := []byte{forbidden | H265_NALU_TYPE_AP<<1 | layerID>>5, layerID<<3 | tid}
+	for _, nal := range nals {
+		packet = append(packet, byte(len(nal)>>8), byte(len(nal)))
+		packet = append(packet, nal...)
+	}
+	return packet
+}
+
+// h265FragmentationUnits splits a NAL in FUs (RFC 7798 4.4.3), the payload
+// header keeps the F, LayerId and TID of the NAL and the FU header carries
+// its type.
+func h265FragmentationUnits(mtu uint16, nal []byte) [][]byte {
+	header := []byte{nal[0]&0x81 | H265_NALU_TYPE_FU<<1, nal[1]}
+	nalType := h265NALType(nal)
+	data := nal[H265_NALU_HEADER_SIZE:]
+	maxFragmentSize := int(mtu) - H265_NALU_HEADER_SIZE - H265_FU_HEADER_SIZE
+	if maxFragmentSize <= 0 {
+		return nil
+	}
+	var payloads [][]byte
+	for start := true; len(data) > 0; start = false {
+		size := len(data)
+		if size > maxFragmentSize {
+			size = maxFragmentSize
+		}
+		fuHeader := nalType
+		if start {
+			fuHeader |= 0x80
+		}
+		if size == len(data) {
+			fuHeader |= 0x40
+		}
+		payload := make([]byte, 0, H265_NALU_HEADER_SIZE+H265_FU_HEADER_SIZE+size)
+		payload = append(payload, header...)
+		payload = append(payload, fuHeader)
+		payload = append(payload, data[:size]...)
+		payloads = append(payloads, payload)
+		data = data[size:]
+	}
+	return payloads
+}
+
+// h265TrackLocalStaticSample is a TrackLocalStaticSample for H265, pion has
+// no H265 payloader so the samples are packetized here and written as RTP.
+type h265TrackLocalStaticSample struct {
+	*webrtc.TrackLocalStaticRTP
+
+	locker     sync.Mutex
+	packetizer rtp.Packetizer
+	sequencer  rtp.Sequencer
+	clockRate  float64
+}
+
+func newH265TrackLocalStaticSample(id, streamID string) (*h265TrackLocalStaticSample, error) {
+	rtpTrack, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265}, id, streamID)
+	if err != nil {
+		return nil, err
+	}
+	return &h265TrackLocalStaticSample{TrackLocalStaticRTP: rtpTrack}, nil
+}
+
+func (t *h265TrackLocalStaticSample) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if err != nil {
+		return codec, err
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if t.packetizer == nil {
+		// SSRC and payload type are set per binding by WriteRTP
+		t.sequencer = rtp.NewRandomSequencer()
+		t.packetizer = rtp.NewPacketizer(H265_RTP_OUTBOUND_MTU, 0, 0,
+			&h265Payloader{}, t.sequencer, codec.ClockRate)
+		t.clockRate = float64(codec.ClockRate)
+	}
+	return codec, nil
+}
+
+func (t *h265TrackLocalStaticSample) WriteSample(sample media.Sample) error {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if t.packetizer == nil {
+		return nil
+	}
+	samples := uint32(sample.Duration.Seconds() * t.clockRate)
+	// the dropped samples are skipped like TrackLocalStaticSample does
+	for i := uint16(0); i < sample.PrevDroppedPackets; i++ {
+		t.sequencer.NextSequenceNumber()
+	}
+	if sample.PrevDroppedPackets > 0 {
+		t.packetizer.SkipSamples(samples * uint32(sample.PrevDroppedPackets))
+	}
+	var writeErr error
+	for _, packet := range t.packetizer.Packetize(sample.Data, samples) {
+		if err := t.WriteRTP(packet); err != nil {
+			writeErr = err
+		}
+	}
+	return writeErr
+}
@@ -0,0 +1,233 @@
+package whep
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testH265NAL is a NAL of the type with LayerId 0 and TID 1, followed by
+// the body.
+func testH265NAL(nalType byte, body ...byte) []byte {
+	return append([]byte{nalType << 1, 0x01}, body...)
+}
+
+func TestAnnexBReader(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		nals [][]byte
+	}{
+		{"four byte start codes", []byte{0, 0, 0, 1, 0x40, 0x01, 0, 0, 0, 1, 0x26, 0x01}, [][]byte{{0x40, 0x01}, {0x26, 0x01}}},
+		{"three byte start codes", []byte{0, 0, 1, 0x40, 0x01, 0, 0, 1, 0x26, 0x01}, [][]byte{{0x40, 0x01}, {0x26, 0x01}}},
+		{"bytes before the first start code", []byte{0x11, 0x22, 0, 0, 1, 0x40, 0x01}, [][]byte{{0x40, 0x01}}},
+		{"trailing zeros", []byte{0, 0, 1, 0x40, 0x01, 0, 0}, [][]byte{{0x40, 0x01}}},
+		{"emulation prevention kept", []byte{0, 0, 1, 0x26, 0x01, 0, 0, 3, 1}, [][]byte{{0x26, 0x01, 0, 0, 3, 1}}},
+		{"empty nal", []byte{0, 0, 1, 0, 0, 1, 0x40, 0x01}, [][]byte{{0x40, 0x01}}},
+		{"no start code", []byte{0x40, 0x01}, nil},
+	}
+	for _, tt := range tests {
+		reader := newAnnexBReader(bytes.NewReader(tt.data))
+		var nals [][]byte
+		for {
+			nal, err := reader.NextNAL()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			nals = append(nals, nal)
+		}
+		if !reflect.DeepEqual(nals, tt.nals) {
+			t.Errorf("%s: % x, want % x", tt.name, nals, tt.nals)
+		}
+	}
+}
+
+func TestH265AccessUnitReader(t *testing.T) {
+	var (
+		vps   = testH265NAL(32, 0x0c)
+		sps   = testH265NAL(33, 0x01)
+		pps   = testH265NAL(34, 0xc1)
+		idr   = testH265NAL(19, 0xaf)
+		cra   = testH265NAL(21, 0xaf)
+		trail = testH265NAL(1, 0xd0)
+		// first_slice_segment_in_pic_flag 0
+		segment = testH265NAL(1, 0x50)
+		aud     = testH265NAL(35, 0x50)
+	)
+	tests := []struct {
+		name  string
+		nals  [][]byte
+		types [][]uint8
+		iraps []bool
+	}{
+		{"parameter sets go with the idr", [][]byte{vps, sps, pps, idr, trail, trail}, [][]uint8{{32, 33, 34, 19}, {1}, {1}}, []bool{true, false, false}},
+		{"slice segments of one picture", [][]byte{cra, segment, trail, segment}, [][]uint8{{21, 1}, {1, 1}}, []bool{true, false}},
+		{"aud opens the access unit", [][]byte{aud, idr, aud, trail}, [][]uint8{{35, 19}, {35, 1}}, []bool{true, false}},
+		{"nal shorter than its header", [][]byte{idr, {0x02}, trail}, [][]uint8{{19}, {1}}, []bool{true, false}},
+	}
+	for _, tt := range tests {
+		var data []byte
+		for _, nal := range tt.nals {
+			data = append(data, annexBStartCode...)
+			data = append(data, nal...)
+		}
+		reader := newH265AccessUnitReader(bytes.NewReader(data))
+		var types [][]uint8
+		var iraps []bool
+		for {
+			au, err := reader.NextAccessUnit()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			var auTypes []uint8
+			for _, nal := range au.nals {
+				auTypes = append(auTypes, h265NALType(nal))
+			}
+			types = append(types, auTypes)
+			iraps = append(iraps, au.irap)
+		}
+		if !reflect.DeepEqual(types, tt.types) || !reflect.DeepEqual(iraps, tt.iraps) {
+			t.Errorf("%s: %v %v, want %v %v", tt.name, types, iraps, tt.types, tt.iraps)
+		}
+	}
+}
+
+func TestParseVPSFrameDuration(t *testing.T) {
+	// one layer and sub-layer, a zero profile_tier_level, the ordering info
+	// and one layer set
+	const head = "0000 1 1 000000 000 1 11111111 11111111 " +
+		"00000000 00000000 00000000 00000000 00000000 00000000 " +
+		"00000000 00000000 00000000 00000000 00000000 00000000 " +
+		"1 1 1 1 000000 1"
+	// 1/25 per tick, an H265 tick is a picture
+	const timing = "1 00000000 00000000 00000000 00000001 00000000 00000000 00000000 00011001 0"
+	vps := func(bits string) []byte {
+		return append([]byte{0x40, 0x01}, testEscapeRBSP(testBits(bits))...)
+	}
+	tests := []struct {
+		name     string
+		vps      []byte
+		duration time.Duration
+		err      bool
+	}{
+		{"timing info", vps(head + timing), 40 * time.Millisecond, false},
+		{"no timing info", vps(head + "0"), 0, false},
+		{"zero tick", vps(head + "1 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00011001"), 0, true},
+		{"truncated", vps(head + "1 00000000 00000000"), 0, true},
+		{"header only", []byte{0x40, 0x01}, 0, true},
+	}
+	for _, tt := range tests {
+		duration, err := parseVPSFrameDuration(tt.vps)
+		if (err != nil) != tt.err || duration != tt.duration {
+			t.Errorf("%s: %v %v, want %v error %v", tt.name, duration, err, tt.duration, tt.err)
+		}
+	}
+}
+
+func TestH265Payloader(t *testing.T) {
+	const mtu = 16
+	annexB := func(nals ...[]byte) []byte {
+		var data []byte
+		for _, nal := range nals {
+			data = append(data, annexBStartCode...)
+			data = append(data, nal...)
+		}
+		return data
+	}
+	ap := func(nals ...[]byte) []byte {
+		return h265AggregationPacket(nals)
+	}
+	body := func(n int) []byte {
+		return bytes.Repeat([]byte{0xab}, n)
+	}
+	small := testH265NAL(1, body(2)...)
+	atMTU := testH265NAL(19, body(mtu-H265_NALU_HEADER_SIZE)...)
+	// a fragment leaves room for the payload and FU headers
+	fuSize := mtu - H265_NALU_HEADER_SIZE - H265_FU_HEADER_SIZE
+	fu := func(start, end bool, data []byte) []byte {
+		header := byte(19)
+		if start {
+			header |= 0x80
+		}
+		if end {
+			header |= 0x40
+		}
+		return append([]byte{H265_NALU_TYPE_FU << 1, 0x01, header}, data...)
+	}
+	tests := []struct {
+		name     string
+		mtu      uint16
+		payload  []byte
+		payloads [][]byte
+	}{
+		{"single nal", mtu, annexB(small), [][]byte{small}},
+		{"aggregated", mtu, annexB(small, small), [][]byte{ap(small, small)}},
+		{
+			// 2 + 3 * (2 + 4) is over 16, the AP is flushed before the third
+			name:     "ap flushed when full",
+			mtu:      mtu,
+			payload:  annexB(small, small, small),
+			payloads: [][]byte{ap(small, small), small},
+		},
+		{"nal of exactly the mtu", mtu, annexB(small, atMTU), [][]byte{small, atMTU}},
+		{
+			name:     "fu split",
+			mtu:      mtu,
+			payload:  annexB(testH265NAL(19, body(fuSize+2)...)),
+			payloads: [][]byte{fu(true, false, body(fuSize)), fu(false, true, body(2))},
+		},
+		{
+			// the fragments fill the MTU exactly, no empty FU follows
+			name:     "fu of exactly the mtu",
+			mtu:      mtu,
+			payload:  annexB(small, testH265NAL(19, body(2*fuSize)...), small),
+			payloads: [][]byte{small, fu(true, false, body(fuSize)), fu(false, true, body(fuSize)), small},
+		},
+		{"nal shorter than its header", mtu, annexB([]byte{0x02}, small), [][]byte{small}},
+		{"mtu too small to fragment", 3, annexB(testH265NAL(19, body(4)...)), nil},
+		{"truncated start code", mtu, []byte{0, 0}, nil},
+	}
+	for _, tt := range tests {
+		payloads := (&h265Payloader{}).Payload(tt.mtu, tt.payload)
+		if !reflect.DeepEqual(payloads, tt.payloads) {
+			t.Errorf("%s: % x, want % x", tt.name, payloads, tt.payloads)
+		}
+		for _, payload := range payloads {
+			if len(payload) > int(tt.mtu) {
+				t.Errorf("%s: payload of %d bytes over the mtu", tt.name, len(payload))
+			}
+		}
+	}
+}
+
+func TestH265AggregationPacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		nals   [][]byte
+		header []byte
+	}{
+		{"same layer", [][]byte{{0x02, 0x01, 0xaa}, {0x26, 0x01}}, []byte{0x60, 0x01}},
+		{"lowest tid", [][]byte{{0x02, 0x03, 0xaa}, {0x26, 0x02}}, []byte{0x60, 0x02}},
+		{"lowest layer id", [][]byte{{0x03, 0x09}, {0x02, 0x11}}, []byte{0x60, 0x11}},
+		{"forbidden bit", [][]byte{{0x82, 0x01}, {0x26, 0x01}}, []byte{0xe0, 0x01}},
+	}
+	for _, tt := range tests {
+		packet := h265AggregationPacket(tt.nals)
+		want := append([]byte{}, tt.header...)
+		for _, nal := range tt.nals {
+			want = append(want, byte(len(nal)>>8), byte(len(nal)))
+			want = append(want, nal...)
+		}
+		if !bytes.Equal(packet, want) {
+			t.Errorf("%s: % x, want % x", tt.name, packet, want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package whep
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// parseICEServers reads the ICE_SERVERS setting, either a comma separated
+// list of STUN/TURN urls without credentials or a JSON array shaped like
+// RTCIceServer:
+//
+//	[{"urls":["turn:turn.example.com:3478?transport=udp"],"username":"user","credential":"pass"}]
+func parseICEServers(s string) ([]webrtc.ICEServer, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") {
+		var servers []webrtc.ICEServer
+		if err := json.Unmarshal([]byte(s), &servers); err != nil {
+			return nil, err
+		}
+		return servers, nil
+	}
+	var servers []webrtc.ICEServer
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			servers = append(servers, webrtc.ICEServer{URLs: []string{u}})
+		}
+	}
+	return servers, nil
+}
+
+// iceServerLinks renders the ICE servers as Link header values with the
+// "ice-server" relation of the WHIP/WHEP specs, one value per url.
+func iceServerLinks(servers []webrtc.ICEServer) []string {
+	var links []string
+	for _, server := range servers {
+		for _, u := range server.URLs {
+			link := "<" + u + `>; rel="ice-server"`
+			if server.Username != "" {
+				link += "; username=" + strconv.Quote(server.Username)
+			}
+			if server.Credential != nil {
+				link += "; credential=" + strconv.Quote(fmt.Sprint(server.Credential))
+				link += `; credential-type="password"`
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+func (h *whepHandler) writeICEServerLinks(w http.ResponseWriter) {
+	for _, link := range iceServerLinks(h.iceServers) {
+		w.Header().Add("Link", link)
+	}
+}
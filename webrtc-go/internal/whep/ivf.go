@@ -0,0 +1,112 @@
+package whep
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+// ivfSource plays a VP8, VP9 or AV1 rendition of the video from an IVF file,
+// the codec comes from the FourCC of the file header.
+type ivfSource struct {
+	fileName string
+	loop     bool
+	mimeType string
+}
+
+func newIVFSource(fileName string, loop bool) (*ivfSource, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	_, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		return nil, err
+	}
+	i := &ivfSource{fileName: fileName, loop: loop}
+	switch header.FourCC {
+	case "VP80":
+		i.mimeType = webrtc.MimeTypeVP8
+	case "VP90":
+		i.mimeType = webrtc.MimeTypeVP9
+	case "AV01":
+		i.mimeType = webrtc.MimeTypeAV1
+	default:
+		return nil, fmt.Errorf("ivf codec %q not supported: %s", header.FourCC, fileName)
+	}
+	return i, nil
+}
+
+func (i *ivfSource) VideoMimeTypes() []string {
+	return []string{i.mimeType}
+}
+
+// Run plays the file in passes on a clock of the group, so the rendition
+// wraps together with the audio of the stream.
+func (i *ivfSource) Run(ctx context.Context, s sampleWriter, group *mediaClockGroup) {
+	clocks := group.NewClocks(1)
+	defer group.Leave(clocks)
+	for {
+		err := i.play(ctx, s, clocks[0])
+		if err != io.EOF {
+			if err != context.Canceled {
+				log.Println(err)
+			}
+			return
+		}
+		if !i.loop || group.Rewind(ctx) != nil {
+			return
+		}
+		log.Println("Rewind Stream IVF:", s.Name(), i.mimeType)
+	}
+}
+
+// play holds each frame until the next one is read since its duration is
+// the distance to the next timestamp, the last frame lasts one timebase.
+func (i *ivfSource) play(ctx context.Context, s sampleWriter, clock *mediaClock) error {
+	file, err := os.Open(i.fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		return err
+	}
+	if header.TimebaseDenominator == 0 {
+		return fmt.Errorf("ivf timebase invalid: %s", i.fileName)
+	}
+	timebase := time.Second * time.Duration(header.TimebaseNumerator) / time.Duration(header.TimebaseDenominator)
+	var pending []byte
+	var pendingTimestamp uint64
+	for {
+		frame, frameHeader, err := reader.ParseNextFrame()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if pending != nil {
+			duration := timebase
+			if err == nil && frameHeader.Timestamp > pendingTimestamp {
+				duration = timebase * time.Duration(frameHeader.Timestamp-pendingTimestamp)
+			}
+			sample := media.Sample{Data: pending, Duration: duration}
+			clock.Skip(&sample)
+			s.WriteSample(i.mimeType, sample)
+			if err := clock.Wait(ctx, duration); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return err
+		}
+		pending, pendingTimestamp = frame, frameHeader.Timestamp
+	}
+}
@@ -0,0 +1,315 @@
+package whep
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// browsers repeat PLI/FIR until their decoder recovers, a subscriber is
+// served at most once per interval
+const KEYFRAME_REQUEST_INTERVAL = time.Second
+
+// gopCacheConfig bounds the GOP kept per video, a longer GOP is dropped and
+// its new subscribers wait for the next keyframe, and sets the pace it is
+// burst at to them.
+type gopCacheConfig struct {
+	MaxFrames int `yaml:"max_frames"`
+	MaxBytes  int `yaml:"max_bytes"`
+	// the burst goes this many times faster than real time, but never over
+	// BurstBitrate nor the GCC target of the session so that it does not
+	// pile up in the pacer queue
+	BurstSpeed   float64 `yaml:"burst_speed"`
+	BurstBitrate int     `yaml:"burst_bitrate"`
+}
+
+func (g *gopCacheConfig) validate() []error {
+	var errs []error
+	if g.MaxFrames < 0 {
+		errs = append(errs, fmt.Errorf("gop_cache: max_frames must not be negative"))
+	}
+	if g.MaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("gop_cache: max_bytes must not be negative"))
+	}
+	if g.BurstSpeed < 1 {
+		errs = append(errs, fmt.Errorf("gop_cache: burst_speed must be at least 1"))
+	}
+	if g.BurstBitrate <= 0 {
+		errs = append(errs, fmt.Errorf("gop_cache: burst_bitrate must be positive"))
+	}
+	return errs
+}
+
+// videoKey names the video of one rendition in one codec.
+type videoKey struct {
+	rendition string
+	mimeType  string
+}
+
+func newVideoKey(rendition, mimeType string) videoKey {
+	return videoKey{rendition: rendition, mimeType: strings.ToLower(mimeType)}
+}
+
+// gopCache is the latest parameter sets of a video and its current group of
+// pictures, the samples from its last keyframe on, none once the GOP
+// outgrew the gopCacheConfig limits.
+type gopCache struct {
+	parameterSets [][]byte
+	samples       []media.Sample
+	bytes         int
+}
+
+// gopBurst is the GOP replayed to a subscriber, followed by the live samples
+// queued while it plays.
+type gopBurst struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	samples []media.Sample
+}
+
+// hasKeyframes reports whether isKeyframe knows the keyframes of the codec,
+// the subscribers of other codecs start on any frame.
+func hasKeyframes(mimeType string) bool {
+	for _, m := range []string{webrtc.MimeTypeH264, webrtc.MimeTypeH265, webrtc.MimeTypeVP8, webrtc.MimeTypeVP9} {
+		if strings.EqualFold(mimeType, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// parameterSets returns the SPS/PPS of an H264 or the VPS/SPS/PPS of an H265
+// Annex-B access unit.
+func parameterSets(mimeType string, data []byte) [][]byte {
+	h265 := strings.EqualFold(mimeType, webrtc.MimeTypeH265)
+	if !h265 && !strings.EqualFold(mimeType, webrtc.MimeTypeH264) {
+		return nil
+	}
+	var sets [][]byte
+	reader := newAnnexBReader(bytes.NewReader(data))
+	for {
+		nal, err := reader.NextNAL()
+		if err != nil {
+			return sets
+		}
+		if len(nal) == 0 {
+			continue
+		}
+		if h265 {
+			if t := h265NALType(nal); t >= H265_NALU_TYPE_VPS && t < H265_NALU_TYPE_AUD {
+				sets = append(sets, nal)
+			}
+		} else if t := nal[0] & 0x1f; t == 7 || t == 8 {
+			sets = append(sets, nal)
+		}
+	}
+}
+
+// cacheVideo adds the sample to the GOP of the video and returns the sample
+// to fan out: a keyframe without parameter sets gets the latest ones, so a
+// subscriber starting on it can decode it.
+func (s *stream) cacheVideo(key videoKey, sample media.Sample, keyframe bool) media.Sample {
+	s.gopLocker.Lock()
+	defer s.gopLocker.Unlock()
+	gop, ok := s.gops[key]
+	if !ok {
+		gop = &gopCache{}
+		s.gops[key] = gop
+	}
+	// only keyframes are searched, encoders send the parameter sets with them
+	if keyframe {
+		if sets := parameterSets(key.mimeType, sample.Data); len(sets) > 0 {
+			gop.parameterSets = sets
+		} else if len(gop.parameterSets) > 0 {
+			var data []byte
+			for _, ps := range gop.parameterSets {
+				data = append(data, annexBStartCode...)
+				data = append(data, ps...)
+			}
+			sample.Data = append(data, sample.Data...)
+		}
+	}
+	if keyframe {
+		gop.samples, gop.bytes = nil, 0
+	}
+	if keyframe || len(gop.samples) > 0 {
+		// the gap of a source wrap is for the live tracks, not a burst
+		cached := sample
+		cached.PrevDroppedPackets = 0
+		gop.samples = append(gop.samples, cached)
+		gop.bytes += len(sample.Data)
+		if len(gop.samples) > s.gopCache.MaxFrames || gop.bytes > s.gopCache.MaxBytes {
+			gop.samples, gop.bytes = nil, 0
+		}
+	}
+	return sample
+}
+
+// clearGOPs drops the cached GOPs when the source of the stream changes.
+func (s *stream) clearGOPs() {
+	s.gopLocker.Lock()
+	defer s.gopLocker.Unlock()
+	s.gops = make(map[videoKey]*gopCache)
+}
+
+// startVideo makes the video of a joining subscriber start on a keyframe:
+// the cached GOP of its rendition is burst to it, or when there is none its
+// video pauses until the next keyframe, which is asked from the publisher.
+// The caller must hold s.locker for writing, so no live sample goes to the
+// subscriber before the burst has started.
+func (s *stream) startVideo(c *whepClient) {
+	mimeType := c.videoTrack.Codec().MimeType
+	if !hasKeyframes(mimeType) {
+		return
+	}
+	rendition, _ := c.Rendition()
+	var samples []media.Sample
+	s.gopLocker.Lock()
+	if gop, ok := s.gops[newVideoKey(rendition, mimeType)]; ok {
+		// the burst queues the live samples behind its own copy
+		samples = append(samples, gop.samples...)
+	}
+	s.gopLocker.Unlock()
+	if len(samples) == 0 {
+		c.setWaitKeyframe(true)
+		if s.publisher != nil {
+			go s.publisher.RequestLayerKeyframe(rendition)
+		}
+		return
+	}
+	c.startBurst(samples, s.gopCache)
+}
+
+// RefreshVideo serves a PLI/FIR of the subscriber without replaying the
+// GOP, which would put its video behind the audio: the publisher is asked
+// for a keyframe of the rendition, the video of the disk files waits for
+// their next one.
+func (s *stream) RefreshVideo(c *whepClient) {
+	if !hasKeyframes(c.videoTrack.Codec().MimeType) || !c.keyframeRequestDue(time.Now()) {
+		return
+	}
+	s.locker.RLock()
+	active := s.subscribers[c]
+	publisher := s.publisher
+	s.locker.RUnlock()
+	if !active {
+		return
+	}
+	if publisher != nil {
+		rendition, _ := c.Rendition()
+		publisher.RequestLayerKeyframe(rendition)
+		return
+	}
+	c.holdVideo()
+}
+
+// startBurst writes the samples to the video track at the burst pace, the
+// live samples written meanwhile are queued behind them. A burst already
+// running is left alone.
+func (c *whepClient) startBurst(samples []media.Sample, config gopCacheConfig) {
+	c.renditionLocker.Lock()
+	defer c.renditionLocker.Unlock()
+	c.waitKeyframe = false
+	if c.burst != nil {
+		return
+	}
+	burst := &gopBurst{samples: samples}
+	burst.ctx, burst.cancel = context.WithCancel(c.ctx)
+	c.burst = burst
+	bitrate := config.BurstBitrate
+	if c.estimator != nil {
+		if target := c.estimator.GetTargetBitrate(); target > 0 && target < bitrate {
+			bitrate = target
+		}
+	}
+	log.Println("Burst GOP:", c.stream.name, len(samples), "frames at", bitrate)
+	c.stream.senders.Add(1)
+	go c.runBurst(burst, config.BurstSpeed, bitrate)
+}
+
+func (c *whepClient) runBurst(burst *gopBurst, speed float64, bitrate int) {
+	defer c.stream.senders.Done()
+	clock := newMediaClock()
+	for {
+		c.renditionLocker.Lock()
+		if c.burst != burst {
+			c.renditionLocker.Unlock()
+			return
+		}
+		if len(burst.samples) == 0 {
+			c.burst = nil
+			c.renditionLocker.Unlock()
+			burst.cancel()
+			return
+		}
+		sample := burst.samples[0]
+		burst.samples = burst.samples[1:]
+		c.renditionLocker.Unlock()
+		if err := c.videoTrack.WriteSample(sample); err != nil {
+			log.Println(err)
+		}
+		interval := time.Duration(float64(sample.Duration) / speed)
+		if d := time.Duration(int64(len(sample.Data)) * 8 * int64(time.Second) / int64(bitrate)); d > interval {
+			interval = d
+		}
+		if err := clock.Wait(burst.ctx, interval); err != nil {
+			return
+		}
+	}
+}
+
+// queueBurst queues the live sample behind the running burst, it reports
+// false when there is none and the sample is to be written.
+func (c *whepClient) queueBurst(sample media.Sample) bool {
+	c.renditionLocker.Lock()
+	defer c.renditionLocker.Unlock()
+	if c.burst == nil {
+		return false
+	}
+	c.burst.samples = append(c.burst.samples, sample)
+	return true
+}
+
+// stopBurst drops the running burst and its queue.
+func (c *whepClient) stopBurst() {
+	c.renditionLocker.Lock()
+	defer c.renditionLocker.Unlock()
+	if c.burst != nil {
+		c.burst.cancel()
+		c.burst = nil
+	}
+}
+
+// holdVideo makes the video of the subscriber wait for the next keyframe,
+// unless a burst, which starts on one, is still running.
+func (c *whepClient) holdVideo() {
+	c.renditionLocker.Lock()
+	defer c.renditionLocker.Unlock()
+	if c.burst == nil {
+		c.waitKeyframe = true
+	}
+}
+
+func (c *whepClient) setWaitKeyframe(wait bool) {
+	c.renditionLocker.Lock()
+	defer c.renditionLocker.Unlock()
+	c.waitKeyframe = wait
+}
+
+// keyframeRequestDue reports whether KEYFRAME_REQUEST_INTERVAL has passed
+// since the last PLI/FIR served.
+func (c *whepClient) keyframeRequestDue(now time.Time) bool {
+	c.renditionLocker.Lock()
+	defer c.renditionLocker.Unlock()
+	if now.Sub(c.keyframeRequested) < KEYFRAME_REQUEST_INTERVAL {
+		return false
+	}
+	c.keyframeRequested = now
+	return true
+}
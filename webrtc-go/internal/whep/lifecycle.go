@@ -0,0 +1,109 @@
+package whep
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sessionState is the lifecycle of a WHEP or WHIP session, it only moves
+// forward.
+type sessionState int
+
+const (
+	// the offer is being answered
+	SESSION_NEGOTIATING sessionState = iota
+	// the answer is sent, the peer connection has connectTimeout to connect
+	SESSION_CONNECTING
+	// the peer connection is connected, it may reconnect after an ICE
+	// restart without leaving the state
+	SESSION_STREAMING
+	// the session is being removed, its ctx is cancelled
+	SESSION_CLOSING
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case SESSION_NEGOTIATING:
+		return "negotiating"
+	case SESSION_CONNECTING:
+		return "connecting"
+	case SESSION_STREAMING:
+		return "streaming"
+	case SESSION_CLOSING:
+		return "closing"
+	}
+	return "unknown"
+}
+
+// lifecycle supervises a client session. Its ctx is the parent of the
+// goroutines of the client, such as the GOP burst and the ABR controller,
+// and is cancelled once the session is closing.
+type lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stateLocker  sync.Mutex
+	state        sessionState
+	connectTimer *time.Timer
+}
+
+func newLifecycle() *lifecycle {
+	l := &lifecycle{}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	return l
+}
+
+func (l *lifecycle) State() sessionState {
+	l.stateLocker.Lock()
+	defer l.stateLocker.Unlock()
+	return l.state
+}
+
+// connecting moves a negotiating session to connecting, onTimeout runs if
+// it is still connecting after timeout.
+func (l *lifecycle) connecting(timeout time.Duration, onTimeout func()) {
+	l.stateLocker.Lock()
+	defer l.stateLocker.Unlock()
+	if l.state != SESSION_NEGOTIATING {
+		return
+	}
+	l.state = SESSION_CONNECTING
+	l.connectTimer = time.AfterFunc(timeout, func() {
+		if l.State() == SESSION_CONNECTING {
+			onTimeout()
+		}
+	})
+}
+
+// streaming moves a connecting session to streaming, it reports whether the
+// session is streaming, which it is not once closing.
+func (l *lifecycle) streaming() bool {
+	l.stateLocker.Lock()
+	defer l.stateLocker.Unlock()
+	switch l.state {
+	case SESSION_CONNECTING:
+		l.connectTimer.Stop()
+		l.state = SESSION_STREAMING
+		return true
+	case SESSION_STREAMING:
+		return true
+	}
+	return false
+}
+
+// closing moves the session to closing and cancels its ctx, it reports
+// false when the session already was.
+func (l *lifecycle) closing() bool {
+	l.stateLocker.Lock()
+	defer l.stateLocker.Unlock()
+	if l.state == SESSION_CLOSING {
+		return false
+	}
+	l.state = SESSION_CLOSING
+	if l.connectTimer != nil {
+		l.connectTimer.Stop()
+	}
+	l.cancel()
+	return true
+}
@@ -0,0 +1,301 @@
+package whep
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	TEST_CONNECT_TIMEOUT = 300 * time.Millisecond
+	TEST_CYCLES          = 10
+	// goroutines of pion that may still be winding down, such as timers
+	TEST_GOROUTINE_SLACK = 5
+)
+
+func newTestHandler(t *testing.T) *whepHandler {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loop := true
+	admission := defaultAdmission
+	admission.RequestRate = 0
+	h := &whepHandler{
+		iceUDPMux:     webrtc.NewICEUDPMux(nil, udpConn),
+		iceNAT1To1IPs: []string{"127.0.0.1"},
+		// the files loop until the last subscriber leaves
+		source: &sourceConfig{
+			VideoFile:         writeTestFile(t, "test.h264", testH264()),
+			AudioFile:         writeTestFile(t, "test.ogg", testOggOpus()),
+			OggPageDuration:   20 * time.Millisecond,
+			H264FrameDuration: 40 * time.Millisecond,
+			Loop:              &loop,
+		},
+		audioCodecs:    defaultAudioCodecs,
+		videoCodecs:    defaultVideoCodecs,
+		interceptors:   defaultInterceptors,
+		gopCache:       defaultGOPCache,
+		profiles:       defaultProfiles,
+		defaultProfile: "nack",
+		connectTimeout: TEST_CONNECT_TIMEOUT,
+		// a closed subscriber is noticed once ICE failed
+		iceDisconnectedTimeout: 500 * time.Millisecond,
+		iceFailedTimeout:       500 * time.Millisecond,
+		admission:              newAdmission(admission),
+		metrics:                newMetrics(),
+		mapWhepClients:         make(map[string]*whepClient),
+		mapWhipClients:         make(map[string]*whipClient),
+		mapStreams:             make(map[string]*stream),
+	}
+	t.Cleanup(func() {
+		h.iceUDPMux.Close()
+	})
+	return h
+}
+
+// testH264 is an Annex-B GOP of an SPS without timing info, a PPS, an IDR
+// and three P slices, 160ms at the H264FrameDuration of the test handler.
+func testH264() []byte {
+	nals := [][]byte{
+		{0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x47, 0xfe, 0xc8},
+		{0x68, 0xce, 0x3c, 0x80},
+		{0x65, 0x88, 0x84, 0x00, 0x33, 0xff},
+		{0x41, 0x9a, 0x02, 0x04},
+		{0x41, 0x9a, 0x04, 0x08},
+		{0x41, 0x9a, 0x06, 0x0c},
+	}
+	var data []byte
+	for _, nal := range nals {
+		data = append(data, annexBStartCode...)
+		data = append(data, nal...)
+	}
+	return data
+}
+
+// testOggOpus is an Ogg Opus file of its two header pages and a page of ten
+// 20ms silent CELT packets, the reader checks neither the CRC nor the
+// granule positions.
+func testOggOpus() []byte {
+	data := testOggPage(0x02, []byte("OpusHead\x01\x02\x38\x01\x80\xbb\x00\x00\x00\x00\x00"))
+	data = append(data, testOggPage(0x00, []byte("OpusTags\x00\x00\x00\x00\x00\x00\x00\x00"))...)
+	var packets [][]byte
+	for i := 0; i < 10; i++ {
+		packets = append(packets, []byte{0xf8, 0xff, 0xfe})
+	}
+	return append(data, testOggPage(0x00, packets...)...)
+}
+
+// newTestSubscriber returns a receive only peer connection with its offer
+// gathered.
+func newTestSubscriber(t *testing.T) *webrtc.PeerConnection {
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetIncludeLoopbackCandidate(true)
+	settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := webrtc.NewAPI(
+		webrtc.WithSettingEngine(settingEngine),
+		webrtc.WithMediaEngine(mediaEngine)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	return pc
+}
+
+// postOffer creates a WHEP session and returns its resource and answer.
+func postOffer(t *testing.T, h *whepHandler, pc *webrtc.PeerConnection) (string, string) {
+	r := httptest.NewRequest(http.MethodPost, "/live/test.whep", strings.NewReader(pc.LocalDescription().SDP))
+	r.Header.Set("Content-Type", "application/sdp")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", w.Code, w.Body.String())
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Path, w.Body.String()
+}
+
+// trickleServerCandidates PATCHes the end of the subscriber candidates,
+// gathered before its offer, and adds the server candidates of the answer
+// fragments until the server has sent them all.
+func trickleServerCandidates(t *testing.T, h *whepHandler, pc *webrtc.PeerConnection, resource, answer string) {
+	if strings.Contains(answer, "a=end-of-candidates") {
+		return
+	}
+	waitFor(t, 5*time.Second, "server candidates", func() bool {
+		r := httptest.NewRequest(http.MethodPatch, resource, strings.NewReader("a=end-of-candidates\r\n"))
+		r.Header.Set("Content-Type", SDP_FRAG_CONTENT_TYPE)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code == http.StatusNoContent {
+			return false
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("PATCH: %d %s", w.Code, w.Body.String())
+		}
+		frag, err := parseSDPFragment(w.Body.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, candidate := range frag.candidates {
+			if err := pc.AddICECandidate(candidate); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return frag.endOfCandidates
+	})
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, done func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func lookupSessionState(h *whepHandler, resource string) (sessionState, bool) {
+	h.locker.RLock()
+	defer h.locker.RUnlock()
+	c, ok := h.mapWhepClients[resource]
+	if !ok {
+		return SESSION_CLOSING, false
+	}
+	return c.State(), true
+}
+
+// abandonBeforeConnect never applies the answer, the session is removed by
+// the connect timeout.
+func abandonBeforeConnect(t *testing.T, h *whepHandler) {
+	pc := newTestSubscriber(t)
+	defer pc.Close()
+	resource, _ := postOffer(t, h, pc)
+	if state, _ := lookupSessionState(h, resource); state != SESSION_CONNECTING {
+		t.Fatalf("state after POST: %s", state)
+	}
+	waitFor(t, 10*TEST_CONNECT_TIMEOUT, "connect timeout", func() bool {
+		_, ok := lookupSessionState(h, resource)
+		return !ok
+	})
+}
+
+// abandonAfterConnect connects and then closes the subscriber without a
+// DELETE, the server sees its peer connection closed.
+func abandonAfterConnect(t *testing.T, h *whepHandler) {
+	pc := newTestSubscriber(t)
+	resource, answer := postOffer(t, h, pc)
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+	trickleServerCandidates(t, h, pc, resource, answer)
+	waitFor(t, 10*time.Second, "streaming", func() bool {
+		state, _ := lookupSessionState(h, resource)
+		return state == SESSION_STREAMING
+	})
+	pc.Close()
+	waitFor(t, 10*time.Second, "session removal", func() bool {
+		_, ok := lookupSessionState(h, resource)
+		return !ok
+	})
+}
+
+func TestSessionLifecycleNoGoroutineLeak(t *testing.T) {
+	h := newTestHandler(t)
+	// the first cycles start the goroutines that pion keeps for good
+	abandonBeforeConnect(t, h)
+	abandonAfterConnect(t, h)
+	baseline := settledGoroutines()
+	for i := 0; i < TEST_CYCLES; i++ {
+		abandonBeforeConnect(t, h)
+		abandonAfterConnect(t, h)
+	}
+	h.locker.RLock()
+	sessions, streams := len(h.mapWhepClients), len(h.mapStreams)
+	h.locker.RUnlock()
+	if sessions != 0 || streams != 0 {
+		t.Fatalf("%d sessions and %d streams left", sessions, streams)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	n := settledGoroutines()
+	for n > baseline+TEST_GOROUTINE_SLACK && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		n = settledGoroutines()
+	}
+	if n > baseline+TEST_GOROUTINE_SLACK {
+		var stacks bytes.Buffer
+		pprof.Lookup("goroutine").WriteTo(&stacks, 1)
+		t.Fatalf("%d goroutines after %d cycles, %d before\n%s", n, TEST_CYCLES, baseline, stacks.String())
+	}
+}
+
+// settledGoroutines counts the goroutines once the closing ones had a
+// moment to exit.
+func settledGoroutines() int {
+	time.Sleep(200 * time.Millisecond)
+	runtime.GC()
+	return runtime.NumGoroutine()
+}
+
+func TestMetricsAuth(t *testing.T) {
+	h := newTestHandler(t)
+	h.tokenValidators = []tokenValidator{newStaticTokenValidator([]string{"stream"})}
+	for _, test := range []struct {
+		name         string
+		metricsToken string
+		token        string
+		path         string
+		status       int
+	}{
+		{"open metrics", "", "", METRICS_PATH, http.StatusOK},
+		{"scrape token", "scrape", "scrape", METRICS_PATH, http.StatusOK},
+		{"stream token on metrics", "scrape", "stream", METRICS_PATH, http.StatusUnauthorized},
+		{"scrape token on stats", "scrape", "scrape", STATS_PATH, http.StatusUnauthorized},
+		{"stream token on stats", "scrape", "stream", STATS_PATH, http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h.metricsToken = test.metricsToken
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("status %d, want %d", rec.Code, test.status)
+			}
+		})
+	}
+}
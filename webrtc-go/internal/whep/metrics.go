@@ -0,0 +1,256 @@
+package whep
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// METRICS_PATH serves the metrics in the Prometheus text format.
+const METRICS_PATH = "/metrics"
+
+// SETUP_LATENCY_BUCKETS are the upper bounds, in seconds, of the session
+// setup latency histogram.
+var SETUP_LATENCY_BUCKETS = []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30}
+
+// trackKey labels the track counters, the profile of the session and the
+// kind of the track.
+type trackKey struct {
+	profile string
+	kind    string
+}
+
+// trackCounters are the counters of the tracks of one trackKey.
+type trackCounters struct {
+	packets              uint64
+	bytes                uint64
+	frames               uint64
+	nacks                uint64
+	retransmittedPackets uint64
+	retransmittedBytes   uint64
+	fecPackets           uint64
+	fecBytes             uint64
+}
+
+func (t *trackCounters) merge(o *trackCounters) {
+	t.packets += o.packets
+	t.bytes += o.bytes
+	t.frames += o.frames
+	t.nacks += o.nacks
+	t.retransmittedPackets += o.retransmittedPackets
+	t.retransmittedBytes += o.retransmittedBytes
+	t.fecPackets += o.fecPackets
+	t.fecBytes += o.fecBytes
+}
+
+func (t *trackCounters) add(s trackStats) {
+	t.packets += s.PacketsSent
+	t.bytes += s.BytesSent
+	t.frames += s.FramesSent
+	t.nacks += uint64(s.NACKCount)
+	t.retransmittedPackets += s.RetransmittedPacketsSent
+	t.retransmittedBytes += s.RetransmittedBytesSent
+	t.fecPackets += s.FECPacketsSent
+	t.fecBytes += s.FECBytesSent
+}
+
+// metrics keeps what outlives the sessions: the setup latencies, the
+// sessions created and the track counters of the closed sessions, which the
+// live sessions are added to on every scrape so the counters never go back.
+type metrics struct {
+	locker          sync.Mutex
+	setupBuckets    []uint64
+	setupSum        float64
+	setupCount      uint64
+	sessionsCreated map[string]uint64
+	closedTracks    map[trackKey]*trackCounters
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		setupBuckets:    make([]uint64, len(SETUP_LATENCY_BUCKETS)),
+		sessionsCreated: make(map[string]uint64),
+		closedTracks:    make(map[trackKey]*trackCounters),
+	}
+}
+
+func (m *metrics) sessionCreated(profile string) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	m.sessionsCreated[profile]++
+}
+
+// observeSetup records the time from the POST of the offer to the peer
+// connection being connected.
+func (m *metrics) observeSetup(d time.Duration) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	seconds := d.Seconds()
+	for i, le := range SETUP_LATENCY_BUCKETS {
+		if seconds <= le {
+			m.setupBuckets[i]++
+		}
+	}
+	m.setupSum += seconds
+	m.setupCount++
+}
+
+// sessionClosed keeps the track counters of a session being removed.
+func (m *metrics) sessionClosed(s *sessionStats) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	addTracks(m.closedTracks, s)
+}
+
+func addTracks(tracks map[trackKey]*trackCounters, s *sessionStats) {
+	for _, t := range s.Tracks {
+		key := trackKey{profile: s.Profile, kind: t.Kind}
+		counters, ok := tracks[key]
+		if !ok {
+			counters = &trackCounters{}
+			tracks[key] = counters
+		}
+		counters.add(t)
+	}
+}
+
+// writeMetrics writes the metrics of the handler. h.locker is held while the
+// live sessions are read, deleteWhepClient moves a session to closedTracks
+// under it, so no session is counted twice or missed.
+func (h *whepHandler) writeMetrics(w http.ResponseWriter) {
+	sessions := make(map[string]int)
+	protocols := map[string]int{"udp": 0, "tcp": 0}
+	estimated := make(map[string]float64)
+	bitrate := make(map[string]float64)
+	tracks := make(map[trackKey]*trackCounters)
+	for name := range h.profiles {
+		sessions[name] = 0
+		estimated[name] = 0
+		bitrate[name] = 0
+	}
+	h.locker.RLock()
+	publishers := len(h.mapWhipClients)
+	streams := len(h.mapStreams)
+	for resource, c := range h.mapWhepClients {
+		s := c.Stats(resource)
+		sessions[s.Profile]++
+		if s.Protocol != "" {
+			protocols[s.Protocol]++
+		}
+		estimated[s.Profile] += float64(s.EstimatedBitrate)
+		bitrate[s.Profile] += s.Bitrate
+		addTracks(tracks, s)
+	}
+	m := h.metrics
+	m.locker.Lock()
+	for key, closed := range m.closedTracks {
+		counters, ok := tracks[key]
+		if !ok {
+			counters = &trackCounters{}
+			tracks[key] = counters
+		}
+		counters.merge(closed)
+	}
+	created := make(map[string]float64, len(m.sessionsCreated))
+	for profile, n := range m.sessionsCreated {
+		created[profile] = float64(n)
+	}
+	setupBuckets := append([]uint64(nil), m.setupBuckets...)
+	setupSum, setupCount := m.setupSum, m.setupCount
+	m.locker.Unlock()
+	h.locker.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	writeFamily(out, "whep_sessions", "gauge", "WHEP sessions by profile.", "profile", toFloat(sessions))
+	writeFamily(out, "whep_sessions_created_total", "counter", "WHEP sessions created by profile.", "profile", created)
+	writeFamily(out, "whep_sessions_ice_transport", "gauge", "WHEP sessions by the protocol of the selected ICE candidate pair.", "protocol", toFloat(protocols))
+	writeFamily(out, "whep_admission_rejected_total", "counter", "Requests turned away by admission control by reason.", "reason", h.admission.rejectedCounts())
+	writeFamily(out, "whep_publishers", "gauge", "WHIP publishers.", "", map[string]float64{"": float64(publishers)})
+	writeFamily(out, "whep_streams", "gauge", "Streams with a publisher, a source or subscribers.", "", map[string]float64{"": float64(streams)})
+
+	fmt.Fprintln(out, "# HELP whep_session_setup_seconds Time from the offer to the peer connection being connected.")
+	fmt.Fprintln(out, "# TYPE whep_session_setup_seconds histogram")
+	for i, le := range SETUP_LATENCY_BUCKETS {
+		fmt.Fprintf(out, "whep_session_setup_seconds_bucket{le=\"%g\"} %d\n", le, setupBuckets[i])
+	}
+	fmt.Fprintf(out, "whep_session_setup_seconds_bucket{le=\"+Inf\"} %d\n", setupCount)
+	fmt.Fprintf(out, "whep_session_setup_seconds_sum %g\n", setupSum)
+	fmt.Fprintf(out, "whep_session_setup_seconds_count %d\n", setupCount)
+
+	keys := make([]trackKey, 0, len(tracks))
+	for key := range tracks {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].profile != keys[j].profile {
+			return keys[i].profile < keys[j].profile
+		}
+		return keys[i].kind < keys[j].kind
+	})
+	for _, family := range []struct {
+		name  string
+		help  string
+		value func(*trackCounters) uint64
+	}{
+		{"whep_track_packets_sent_total", "Media RTP packets sent.", func(t *trackCounters) uint64 { return t.packets }},
+		{"whep_track_bytes_sent_total", "Media RTP payload bytes sent, headers excluded like the bytesSent of WebRTC stats.", func(t *trackCounters) uint64 { return t.bytes }},
+		{"whep_track_frames_sent_total", "Video frames sent.", func(t *trackCounters) uint64 { return t.frames }},
+		{"whep_track_nacks_received_total", "NACKs received.", func(t *trackCounters) uint64 { return t.nacks }},
+		{"whep_track_retransmitted_packets_sent_total", "RTX packets sent.", func(t *trackCounters) uint64 { return t.retransmittedPackets }},
+		{"whep_track_retransmitted_bytes_sent_total", "RTX payload bytes sent.", func(t *trackCounters) uint64 { return t.retransmittedBytes }},
+		{"whep_track_fec_packets_sent_total", "FlexFEC packets sent.", func(t *trackCounters) uint64 { return t.fecPackets }},
+		{"whep_track_fec_bytes_sent_total", "FlexFEC payload bytes sent, the FEC overhead.", func(t *trackCounters) uint64 { return t.fecBytes }},
+	} {
+		fmt.Fprintf(out, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(out, "# TYPE %s counter\n", family.name)
+		for _, key := range keys {
+			fmt.Fprintf(out, "%s{profile=\"%s\",kind=\"%s\"} %d\n",
+				family.name, escapeLabel(key.profile), escapeLabel(key.kind), family.value(tracks[key]))
+		}
+	}
+
+	writeFamily(out, "whep_estimated_bitrate_bps", "gauge", "Sum of the GCC target bitrates of the sessions by profile.", "profile", estimated)
+	writeFamily(out, "whep_sent_bitrate_bps", "gauge", "Sum of the bitrates sent to the sessions by profile, RTX and FEC included.", "profile", bitrate)
+}
+
+// writeFamily writes a metric with one sample per label value, or a single
+// sample without labels when label is empty.
+func writeFamily(out *bufio.Writer, name, typ, help, label string, values map[string]float64) {
+	fmt.Fprintf(out, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(out, "# TYPE %s %s\n", name, typ)
+	if label == "" {
+		fmt.Fprintf(out, "%s %g\n", name, values[""])
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(out, "%s{%s=\"%s\"} %g\n", name, label, escapeLabel(k), values[k])
+	}
+}
+
+func toFloat(values map[string]int) map[string]float64 {
+	floats := make(map[string]float64, len(values))
+	for k, v := range values {
+		floats[k] = float64(v)
+	}
+	return floats
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
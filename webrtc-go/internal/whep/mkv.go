@@ -0,0 +1,298 @@
+package whep
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// MKV_DEFAULT_TIMECODE_SCALE is the nanoseconds per timecode tick when the
+// segment info does not set TimecodeScale.
+const MKV_DEFAULT_TIMECODE_SCALE = 1000000
+
+// mkvSource plays the first video track (H264, VP8 or VP9) and the first
+// Opus track of a Matroska or WebM file, the block timestamps are cluster
+// timecodes plus the block relative timecode.
+type mkvSource struct {
+	fileName      string
+	loop          bool
+	timecodeScale uint64
+	tracks        []*mkvTrack
+}
+
+type mkvTrack struct {
+	number   uint64
+	kind     webrtc.RTPCodecType
+	mimeType string
+	// H264 only, the CodecPrivate of V_MPEG4/ISO/AVC
+	avc *avcConfig
+}
+
+// mkvHeader is the part of the segment read before the first cluster.
+type mkvHeader struct {
+	Segment struct {
+		Info struct {
+			TimecodeScale uint64
+		}
+		Tracks struct {
+			TrackEntry []struct {
+				TrackNumber  uint64
+				CodecID      string
+				CodecPrivate []byte
+			}
+		} `ebml:"Tracks,stop"`
+	}
+}
+
+func newMKVSource(fileName string, loop bool) *mkvSource {
+	m := &mkvSource{fileName: fileName, loop: loop}
+	if err := m.readHeader(); err != nil {
+		log.Println(err)
+	}
+	return m
+}
+
+func (m *mkvSource) readHeader() error {
+	file, err := os.Open(m.fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var header mkvHeader
+	if err := ebml.Unmarshal(file, &header); err != nil && err != ebml.ErrReadStopped {
+		return err
+	}
+	m.timecodeScale = header.Segment.Info.TimecodeScale
+	if m.timecodeScale == 0 {
+		m.timecodeScale = MKV_DEFAULT_TIMECODE_SCALE
+	}
+	var hasVideo, hasAudio bool
+	for _, entry := range header.Segment.Tracks.TrackEntry {
+		track := &mkvTrack{number: entry.TrackNumber, kind: webrtc.RTPCodecTypeVideo}
+		switch entry.CodecID {
+		case "V_MPEG4/ISO/AVC":
+			if track.avc, err = parseAVCConfig(entry.CodecPrivate); err != nil {
+				return err
+			}
+			track.mimeType = webrtc.MimeTypeH264
+		case "V_VP8":
+			track.mimeType = webrtc.MimeTypeVP8
+		case "V_VP9":
+			track.mimeType = webrtc.MimeTypeVP9
+		case "A_OPUS":
+			track.kind = webrtc.RTPCodecTypeAudio
+			track.mimeType = webrtc.MimeTypeOpus
+		default:
+			log.Println("mkv track skipped:", entry.TrackNumber, entry.CodecID)
+			continue
+		}
+		if track.kind == webrtc.RTPCodecTypeVideo && !hasVideo {
+			hasVideo = true
+			m.tracks = append(m.tracks, track)
+		} else if track.kind == webrtc.RTPCodecTypeAudio && !hasAudio {
+			hasAudio = true
+			m.tracks = append(m.tracks, track)
+		}
+	}
+	if len(m.tracks) == 0 {
+		return errors.New("mkv has no h264, vp8, vp9 or opus track")
+	}
+	return nil
+}
+
+func (m *mkvSource) VideoMimeTypes() []string {
+	for _, track := range m.tracks {
+		if track.kind == webrtc.RTPCodecTypeVideo {
+			return []string{track.mimeType}
+		}
+	}
+	return nil
+}
+
+func (m *mkvSource) Run(ctx context.Context, s sampleWriter, group *mediaClockGroup) {
+	all := group.NewClocks(len(m.tracks))
+	defer group.Leave(all)
+	if len(m.tracks) == 0 {
+		log.Println("mkv has no track to play:", m.fileName)
+		return
+	}
+	clocks := make(map[uint64]*mediaClock)
+	for i, track := range m.tracks {
+		clocks[track.number] = all[i]
+	}
+	for {
+		err := m.play(ctx, s, clocks)
+		if err != io.EOF {
+			if err != context.Canceled {
+				log.Println(err)
+			}
+			return
+		}
+		if !m.loop || group.Rewind(ctx) != nil {
+			return
+		}
+		log.Println("Rewind Stream MKV:", s.Name())
+	}
+}
+
+// mkvCluster is read whole so every block is stamped with the timecode of
+// its own cluster, mkvcore.NewSimpleBlockReader reads the timecode from
+// another goroutine than the one filling it and may stamp the last blocks of
+// a cluster with the timecode of the next one.
+type mkvCluster struct {
+	Timecode    uint64
+	SimpleBlock []ebml.Block
+	BlockGroup  []struct {
+		Block          ebml.Block
+		ReferenceBlock []int64
+	}
+}
+
+// mkvFrame is one frame of a block, timestamp is in TimecodeScale units.
+type mkvFrame struct {
+	data      []byte
+	keyframe  bool
+	timestamp int64
+}
+
+// play demuxes the file once, every track is paced by its own clock and the
+// pass ends when all of them reach EOF. The clocks outlive the pass and are
+// aligned before the next one, so the tracks wrap together.
+func (m *mkvSource) play(ctx context.Context, s sampleWriter, clocks map[uint64]*mediaClock) error {
+	file, err := os.Open(m.fileName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var segment struct {
+		Segment struct {
+			Cluster chan mkvCluster
+		}
+	}
+	clusters := make(chan mkvCluster)
+	segment.Segment.Cluster = clusters
+	unmarshalErr := make(chan error, 1)
+	go func() {
+		unmarshalErr <- ebml.Unmarshal(file, &segment)
+		close(clusters)
+	}()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(m.tracks))
+	frames := make(map[uint64]chan *mkvFrame)
+	for _, track := range m.tracks {
+		ch := make(chan *mkvFrame)
+		frames[track.number] = ch
+		wg.Add(1)
+		go func(track *mkvTrack) {
+			defer wg.Done()
+			if err := m.playTrack(ctx, s, ch, track, clocks[track.number]); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(track)
+	}
+	demuxErr := m.demux(ctx, clusters, frames)
+	for _, ch := range frames {
+		close(ch)
+	}
+	wg.Wait()
+	// closing the file makes the unmarshal fail if it is not done yet
+	file.Close()
+	for range clusters {
+	}
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+	if demuxErr != nil {
+		return demuxErr
+	}
+	if err := <-unmarshalErr; err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// demux hands the frames of the played tracks to their goroutines in file
+// order, the blocks of other tracks are dropped.
+func (m *mkvSource) demux(ctx context.Context, clusters <-chan mkvCluster, frames map[uint64]chan *mkvFrame) error {
+	for cluster := range clusters {
+		blocks := cluster.SimpleBlock
+		for _, group := range cluster.BlockGroup {
+			block := group.Block
+			block.Keyframe = len(group.ReferenceBlock) == 0
+			blocks = append(blocks, block)
+		}
+		for _, block := range blocks {
+			ch, ok := frames[block.TrackNumber]
+			if !ok {
+				continue
+			}
+			for _, data := range block.Data {
+				frame := &mkvFrame{
+					data:      data,
+					keyframe:  block.Keyframe,
+					timestamp: int64(cluster.Timecode) + int64(block.Timecode),
+				}
+				select {
+				case ch <- frame:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// playTrack holds each frame until the next one is read since its duration
+// is the distance to the next timestamp, the last frame reuses the previous
+// duration.
+func (m *mkvSource) playTrack(ctx context.Context, s sampleWriter, frames <-chan *mkvFrame, track *mkvTrack, clock *mediaClock) error {
+	var pending *mkvFrame
+	var duration time.Duration
+	started := track.kind == webrtc.RTPCodecTypeAudio
+	for {
+		frame, ok := <-frames
+		if pending != nil {
+			if ok {
+				if d := time.Duration(frame.timestamp-pending.timestamp) * time.Duration(m.timecodeScale); d > 0 {
+					duration = d
+				}
+			}
+			sample := media.Sample{Data: pending.data, Duration: duration}
+			clock.Skip(&sample)
+			s.WriteSample(track.mimeType, sample)
+			if err := clock.Wait(ctx, duration); err != nil {
+				return err
+			}
+			pending = nil
+		}
+		if !ok {
+			return nil
+		}
+		if !started && !frame.keyframe {
+			// the video starts at the first keyframe
+			continue
+		}
+		started = true
+		if track.avc != nil {
+			data, err := track.avc.annexB(frame.data, frame.keyframe)
+			if err != nil {
+				return err
+			}
+			frame.data = data
+		}
+		pending = frame
+	}
+}
@@ -0,0 +1,226 @@
+package whep
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// testEBML is an element of the id and the data, its size is an 8 byte
+// vint.
+func testEBML(id uint32, parts ...[]byte) []byte {
+	var element []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> uint(shift)); b != 0 || len(element) > 0 {
+			element = append(element, b)
+		}
+	}
+	data := bytes.Join(parts, nil)
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(data)))
+	size[0] = 0x01
+	element = append(element, size...)
+	return append(element, data...)
+}
+
+const (
+	TEST_EBML_SEGMENT         = 0x18538067
+	TEST_EBML_INFO            = 0x1549a966
+	TEST_EBML_TIMECODE_SCALE  = 0x2ad7b1
+	TEST_EBML_TRACKS          = 0x1654ae6b
+	TEST_EBML_TRACK_ENTRY     = 0xae
+	TEST_EBML_TRACK_NUMBER    = 0xd7
+	TEST_EBML_CODEC_ID        = 0x86
+	TEST_EBML_CODEC_PRIVATE   = 0x63a2
+	TEST_EBML_CLUSTER         = 0x1f43b675
+	TEST_EBML_TIMECODE        = 0xe7
+	TEST_EBML_SIMPLE_BLOCK    = 0xa3
+	TEST_EBML_BLOCK_GROUP     = 0xa0
+	TEST_EBML_BLOCK           = 0xa1
+	TEST_EBML_REFERENCE_BLOCK = 0xfb
+)
+
+func testMKVTrackEntry(number byte, codecID string, codecPrivate []byte) []byte {
+	parts := [][]byte{
+		testEBML(TEST_EBML_TRACK_NUMBER, []byte{number}),
+		testEBML(TEST_EBML_CODEC_ID, []byte(codecID)),
+	}
+	if codecPrivate != nil {
+		parts = append(parts, testEBML(TEST_EBML_CODEC_PRIVATE, codecPrivate))
+	}
+	return testEBML(TEST_EBML_TRACK_ENTRY, parts...)
+}
+
+// testMKVBlock is the body of a SimpleBlock or Block without lacing.
+func testMKVBlock(track byte, timecode int16, keyframe bool, data ...byte) []byte {
+	flags := byte(0)
+	if keyframe {
+		flags = 0x80
+	}
+	block := []byte{0x80 | track, byte(uint16(timecode) >> 8), byte(timecode), flags}
+	return append(block, data...)
+}
+
+func testMKVFile(t *testing.T, scale []byte, entries [][]byte, clusters ...[]byte) string {
+	info := testEBML(TEST_EBML_INFO)
+	if scale != nil {
+		info = testEBML(TEST_EBML_INFO, testEBML(TEST_EBML_TIMECODE_SCALE, scale))
+	}
+	segment := append([][]byte{info, testEBML(TEST_EBML_TRACKS, entries...)}, clusters...)
+	return writeTestFile(t, "test.mkv", testEBML(TEST_EBML_SEGMENT, segment...))
+}
+
+func TestMKVReadHeader(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e}
+	pps := []byte{0x68, 0xce}
+	avcC := append(append([]byte{0x01, 0x42, 0xc0, 0x1e, 0xff, 0xe1, 0x00, 0x04}, sps...), 0x01, 0x00, 0x02)
+	avcC = append(avcC, pps...)
+	tests := []struct {
+		name    string
+		scale   []byte
+		entries [][]byte
+		tracks  []*mkvTrack
+		scaleNs uint64
+		err     bool
+	}{
+		{
+			name:    "h264 and opus",
+			entries: [][]byte{testMKVTrackEntry(1, "V_MPEG4/ISO/AVC", avcC), testMKVTrackEntry(2, "A_OPUS", nil)},
+			tracks: []*mkvTrack{
+				{number: 1, kind: webrtc.RTPCodecTypeVideo, mimeType: webrtc.MimeTypeH264,
+					avc: &avcConfig{lengthSize: 4, parameterSets: [][]byte{sps, pps}}},
+				{number: 2, kind: webrtc.RTPCodecTypeAudio, mimeType: webrtc.MimeTypeOpus},
+			},
+			scaleNs: MKV_DEFAULT_TIMECODE_SCALE,
+		},
+		{
+			name:  "first video and audio tracks only",
+			scale: []byte{0x0f, 0x42, 0x40},
+			entries: [][]byte{
+				testMKVTrackEntry(1, "A_VORBIS", nil),
+				testMKVTrackEntry(2, "V_VP9", nil),
+				testMKVTrackEntry(3, "V_VP8", nil),
+				testMKVTrackEntry(4, "A_OPUS", nil),
+				testMKVTrackEntry(5, "A_OPUS", nil),
+			},
+			tracks: []*mkvTrack{
+				{number: 2, kind: webrtc.RTPCodecTypeVideo, mimeType: webrtc.MimeTypeVP9},
+				{number: 4, kind: webrtc.RTPCodecTypeAudio, mimeType: webrtc.MimeTypeOpus},
+			},
+			scaleNs: 1000000,
+		},
+		{
+			name:    "no track to play",
+			entries: [][]byte{testMKVTrackEntry(1, "A_VORBIS", nil)},
+			scaleNs: MKV_DEFAULT_TIMECODE_SCALE,
+			err:     true,
+		},
+		{
+			name:    "truncated avcC",
+			entries: [][]byte{testMKVTrackEntry(1, "V_MPEG4/ISO/AVC", avcC[:len(avcC)-1])},
+			scaleNs: MKV_DEFAULT_TIMECODE_SCALE,
+			err:     true,
+		},
+	}
+	for _, tt := range tests {
+		m := &mkvSource{fileName: testMKVFile(t, tt.scale, tt.entries)}
+		err := m.readHeader()
+		if (err != nil) != tt.err || !reflect.DeepEqual(m.tracks, tt.tracks) || m.timecodeScale != tt.scaleNs {
+			t.Errorf("%s: %v %v %d, want error %v", tt.name, m.tracks, err, m.timecodeScale, tt.err)
+		}
+	}
+}
+
+// testSampleWriter records the samples of a source, onSample is called
+// with the count of samples so far.
+type testSampleWriter struct {
+	locker    sync.Mutex
+	mimeTypes []string
+	samples   []media.Sample
+	onSample  func(n int)
+}
+
+func (w *testSampleWriter) Name() string {
+	return "test"
+}
+
+func (w *testSampleWriter) WriteSample(mimeType string, sample media.Sample) {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+	w.mimeTypes = append(w.mimeTypes, mimeType)
+	w.samples = append(w.samples, sample)
+	if w.onSample != nil {
+		w.onSample(len(w.samples))
+	}
+}
+
+func TestMKVSourcePlay(t *testing.T) {
+	entries := [][]byte{testMKVTrackEntry(1, "V_VP8", nil), testMKVTrackEntry(2, "A_OPUS", nil)}
+	clusters := [][]byte{
+		testEBML(TEST_EBML_CLUSTER,
+			testEBML(TEST_EBML_TIMECODE, []byte{0}),
+			// the video waits for its first keyframe
+			testEBML(TEST_EBML_SIMPLE_BLOCK, testMKVBlock(1, 0, false, 0x01)),
+			testEBML(TEST_EBML_SIMPLE_BLOCK, testMKVBlock(1, 0, true, 0x02)),
+			testEBML(TEST_EBML_SIMPLE_BLOCK, testMKVBlock(2, 0, true, 0x11)),
+			testEBML(TEST_EBML_SIMPLE_BLOCK, testMKVBlock(1, 5, false, 0x03)),
+			testEBML(TEST_EBML_SIMPLE_BLOCK, testMKVBlock(2, 10, true, 0x12)),
+		),
+		// a block group with a reference is not a keyframe
+		testEBML(TEST_EBML_CLUSTER,
+			testEBML(TEST_EBML_TIMECODE, []byte{20}),
+			testEBML(TEST_EBML_BLOCK_GROUP,
+				testEBML(TEST_EBML_BLOCK, testMKVBlock(1, 0, false, 0x04)),
+				testEBML(TEST_EBML_REFERENCE_BLOCK, []byte{0xf1}),
+			),
+			testEBML(TEST_EBML_SIMPLE_BLOCK, testMKVBlock(2, 0, true, 0x13)),
+		),
+	}
+	type frame struct {
+		data     byte
+		duration time.Duration
+	}
+	tests := []struct {
+		name     string
+		clusters [][]byte
+		video    []frame
+		audio    []frame
+	}{
+		{
+			// the last frame lasts as long as the one before
+			name:     "two clusters",
+			clusters: clusters,
+			video:    []frame{{0x02, 5 * time.Millisecond}, {0x03, 15 * time.Millisecond}, {0x04, 15 * time.Millisecond}},
+			audio:    []frame{{0x11, 10 * time.Millisecond}, {0x12, 10 * time.Millisecond}, {0x13, 10 * time.Millisecond}},
+		},
+		{
+			name:     "truncated cluster",
+			clusters: [][]byte{clusters[0], clusters[1][:len(clusters[1])-3]},
+			video:    []frame{{0x02, 5 * time.Millisecond}, {0x03, 5 * time.Millisecond}},
+			audio:    []frame{{0x11, 10 * time.Millisecond}, {0x12, 10 * time.Millisecond}},
+		},
+	}
+	for _, tt := range tests {
+		m := newMKVSource(testMKVFile(t, nil, entries, tt.clusters...), false)
+		var s testSampleWriter
+		m.Run(context.Background(), &s, newMediaClockGroup())
+		var video, audio []frame
+		for i, sample := range s.samples {
+			f := frame{sample.Data[0], sample.Duration}
+			if s.mimeTypes[i] == webrtc.MimeTypeVP8 {
+				video = append(video, f)
+			} else {
+				audio = append(audio, f)
+			}
+		}
+		if !reflect.DeepEqual(video, tt.video) || !reflect.DeepEqual(audio, tt.audio) {
+			t.Errorf("%s: video %v audio %v, want %v %v", tt.name, video, audio, tt.video, tt.audio)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package whep
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/abema/go-mp4"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// mp4Source plays the H264 and Opus tracks of an MP4 file straight from its
+// sample tables, other tracks such as AAC are skipped.
+type mp4Source struct {
+	fileName string
+	loop     bool
+}
+
+// mp4Track is the flattened sample table of a track, sample i is read at
+// offsets[i] and lasts durations[i] in timescale units.
+type mp4Track struct {
+	kind      webrtc.RTPCodecType
+	mimeType  string
+	timescale uint32
+	offsets   []uint64
+	sizes     []uint32
+	durations []uint32
+	// syncs is nil when every sample is a sync sample (no stss)
+	syncs map[uint32]bool
+
+	// AVC only, the avcC of the sample entry
+	avc *avcConfig
+}
+
+// VideoMimeTypes is H264 since avc1 is the only video sample entry played.
+func (m *mp4Source) VideoMimeTypes() []string {
+	return []string{webrtc.MimeTypeH264}
+}
+
+// Run plays the tracks in passes on clocks of the group, the next pass
+// starts once every track and the other sources of the group reached EOF so
+// the tracks wrap together.
+func (m *mp4Source) Run(ctx context.Context, s sampleWriter, group *mediaClockGroup) {
+	var clocks []*mediaClock
+	defer func() {
+		group.Leave(clocks)
+	}()
+	tracks, err := readMP4Tracks(m.fileName)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	file, err := os.Open(m.fileName)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer func() {
+		file.Close()
+	}()
+	clocks = group.NewClocks(len(tracks))
+	for {
+		var wg sync.WaitGroup
+		errs := make([]error, len(tracks))
+		for i, track := range tracks {
+			wg.Add(1)
+			go func(i int, track *mp4Track) {
+				defer wg.Done()
+				errs[i] = m.playTrack(ctx, s, file, track, clocks[i])
+			}(i, track)
+		}
+		wg.Wait()
+		done := !m.loop
+		for _, err := range errs {
+			if err == io.EOF {
+				continue
+			}
+			if err != context.Canceled {
+				log.Println(err)
+			}
+			done = true
+		}
+		if done || group.Rewind(ctx) != nil {
+			return
+		}
+		log.Println("Rewind Stream MP4:", s.Name())
+	}
+}
+
+func (m *mp4Source) playTrack(ctx context.Context, s sampleWriter, file *os.File, track *mp4Track, clock *mediaClock) error {
+	for i := range track.sizes {
+		data := make([]byte, track.sizes[i])
+		if _, err := file.ReadAt(data, int64(track.offsets[i])); err != nil {
+			return unexpectedEOF(err)
+		}
+		if track.kind == webrtc.RTPCodecTypeVideo {
+			var err error
+			if data, err = track.avc.annexB(data, track.isSync(i)); err != nil {
+				return err
+			}
+		}
+		duration := time.Duration(track.durations[i]) * time.Second / time.Duration(track.timescale)
+		sample := media.Sample{Data: data, Duration: duration}
+		clock.Skip(&sample)
+		s.WriteSample(track.mimeType, sample)
+		if err := clock.Wait(ctx, duration); err != nil {
+			return err
+		}
+	}
+	return io.EOF
+}
+
+func (t *mp4Track) isSync(i int) bool {
+	return t.syncs == nil || t.syncs[uint32(i+1)]
+}
+
+func readMP4Tracks(fileName string) ([]*mp4Track, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	traks, err := mp4.ExtractBox(file, nil, mp4.BoxPath{mp4.BoxTypeMoov(), mp4.BoxTypeTrak()})
+	if err != nil {
+		return nil, err
+	}
+	var tracks []*mp4Track
+	for _, trak := range traks {
+		track, err := readMP4Track(file, trak)
+		if err != nil {
+			return nil, err
+		}
+		if track != nil {
+			tracks = append(tracks, track)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil, errors.New("mp4 has no h264 or opus track")
+	}
+	return tracks, nil
+}
+
+var (
+	boxTypeOpus = mp4.StrToBoxType("Opus")
+
+	stblPath = mp4.BoxPath{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl()}
+)
+
+func stblBoxPath(types ...mp4.BoxType) mp4.BoxPath {
+	return append(append(mp4.BoxPath{}, stblPath...), types...)
+}
+
+// readMP4Track returns nil for tracks whose codec can not be sent.
+func readMP4Track(file *os.File, trak *mp4.BoxInfo) (*mp4Track, error) {
+	track := &mp4Track{}
+	avc1, err := mp4.ExtractBox(file, trak, stblBoxPath(mp4.BoxTypeStsd(), mp4.BoxTypeAvc1()))
+	if err != nil {
+		return nil, err
+	}
+	opus, err := mp4.ExtractBox(file, trak, stblBoxPath(mp4.BoxTypeStsd(), boxTypeOpus))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(avc1) > 0:
+		track.kind = webrtc.RTPCodecTypeVideo
+		track.mimeType = webrtc.MimeTypeH264
+		boxes, err := mp4.ExtractBoxWithPayload(file, trak, stblBoxPath(mp4.BoxTypeStsd(), mp4.BoxTypeAvc1(), mp4.BoxTypeAvcC()))
+		if err != nil {
+			return nil, err
+		}
+		if len(boxes) == 0 {
+			return nil, errors.New("mp4 avc1 has no avcC")
+		}
+		avcC := boxes[0].Payload.(*mp4.AVCDecoderConfiguration)
+		track.avc = &avcConfig{lengthSize: int(avcC.LengthSizeMinusOne) + 1}
+		for _, ps := range avcC.SequenceParameterSets {
+			track.avc.parameterSets = append(track.avc.parameterSets, ps.NALUnit)
+		}
+		for _, ps := range avcC.PictureParameterSets {
+			track.avc.parameterSets = append(track.avc.parameterSets, ps.NALUnit)
+		}
+	case len(opus) > 0:
+		track.kind = webrtc.RTPCodecTypeAudio
+		track.mimeType = webrtc.MimeTypeOpus
+	default:
+		return nil, nil
+	}
+	boxes, err := mp4.ExtractBoxesWithPayload(file, trak, []mp4.BoxPath{
+		{mp4.BoxTypeMdia(), mp4.BoxTypeMdhd()},
+		stblBoxPath(mp4.BoxTypeStts()),
+		stblBoxPath(mp4.BoxTypeCtts()),
+		stblBoxPath(mp4.BoxTypeStss()),
+		stblBoxPath(mp4.BoxTypeStsz()),
+		stblBoxPath(mp4.BoxTypeStsc()),
+		stblBoxPath(mp4.BoxTypeStco()),
+		stblBoxPath(mp4.BoxTypeCo64()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var stsc *mp4.Stsc
+	var chunkOffsets []uint64
+	for _, box := range boxes {
+		switch b := box.Payload.(type) {
+		case *mp4.Mdhd:
+			track.timescale = b.Timescale
+		case *mp4.Stts:
+			for _, entry := range b.Entries {
+				for i := uint32(0); i < entry.SampleCount; i++ {
+					track.durations = append(track.durations, entry.SampleDelta)
+				}
+			}
+		case *mp4.Ctts:
+			// the RTP timestamps follow the sample durations, so the frames
+			// can only be sent in decode order, a constant offset is a delay
+			for i := range b.Entries {
+				if b.GetSampleOffset(i) != b.GetSampleOffset(0) {
+					return nil, errors.New("mp4 track has B-frames, encode it with -bf 0")
+				}
+			}
+		case *mp4.Stss:
+			track.syncs = make(map[uint32]bool)
+			for _, n := range b.SampleNumber {
+				track.syncs[n] = true
+			}
+		case *mp4.Stsz:
+			for i := uint32(0); i < b.SampleCount; i++ {
+				if b.SampleSize != 0 {
+					track.sizes = append(track.sizes, b.SampleSize)
+				} else {
+					track.sizes = append(track.sizes, b.EntrySize[i])
+				}
+			}
+		case *mp4.Stsc:
+			stsc = b
+		case *mp4.Stco:
+			for _, offset := range b.ChunkOffset {
+				chunkOffsets = append(chunkOffsets, uint64(offset))
+			}
+		case *mp4.Co64:
+			chunkOffsets = append(chunkOffsets, b.ChunkOffset...)
+		}
+	}
+	if track.timescale == 0 || stsc == nil || len(track.durations) != len(track.sizes) {
+		return nil, errors.New("mp4 sample table invalid")
+	}
+	// each stsc entry covers the chunks up to the next entry's first chunk
+	for i, entry := range stsc.Entries {
+		lastChunk := uint32(len(chunkOffsets))
+		if i+1 < len(stsc.Entries) {
+			lastChunk = stsc.Entries[i+1].FirstChunk - 1
+		}
+		for chunk := entry.FirstChunk; chunk <= lastChunk && chunk >= 1 && int(chunk) <= len(chunkOffsets); chunk++ {
+			offset := chunkOffsets[chunk-1]
+			for n := uint32(0); n < entry.SamplesPerChunk; n++ {
+				sample := len(track.offsets)
+				if sample >= len(track.sizes) {
+					break
+				}
+				track.offsets = append(track.offsets, offset)
+				offset += uint64(track.sizes[sample])
+			}
+		}
+	}
+	if len(track.offsets) != len(track.sizes) {
+		return nil, errors.New("mp4 chunk table invalid")
+	}
+	return track, nil
+}
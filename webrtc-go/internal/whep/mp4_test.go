@@ -0,0 +1,278 @@
+package whep
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// writeTestFile writes data to a file of the test's temp dir.
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func testMP4Box(boxType string, parts ...[]byte) []byte {
+	payload := bytes.Join(parts, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	box = append(box, boxType...)
+	return append(box, payload...)
+}
+
+// testMP4FullBox is a version 0 box without flags.
+func testMP4FullBox(boxType string, parts ...[]byte) []byte {
+	return testMP4Box(boxType, append([][]byte{{0, 0, 0, 0}}, parts...)...)
+}
+
+func testU32(values ...uint32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// testMP4Track is a trak of the sample entry and the sample tables, the
+// mdhd timescale is 1000.
+func testMP4Track(entry []byte, tables ...[]byte) []byte {
+	mdhd := testMP4FullBox("mdhd", testU32(0, 0, 1000, 0), []byte{0x55, 0xc4, 0, 0})
+	stsd := testMP4FullBox("stsd", testU32(1), entry)
+	stbl := testMP4Box("stbl", append([][]byte{stsd}, tables...)...)
+	return testMP4Box("trak", testMP4Box("mdia", mdhd, testMP4Box("minf", stbl)))
+}
+
+func testAVC1Entry(sps, pps []byte) []byte {
+	// reserved, data_reference_index 1, then the visual sample entry fields
+	fields := make([]byte, 78)
+	fields[7] = 1
+	avcC := []byte{0x01, sps[1], sps[2], sps[3], 0xff, 0xe1, 0x00, byte(len(sps))}
+	avcC = append(avcC, sps...)
+	avcC = append(avcC, 0x01, 0x00, byte(len(pps)))
+	avcC = append(avcC, pps...)
+	return testMP4Box("avc1", fields, testMP4Box("avcC", avcC))
+}
+
+func testOpusEntry() []byte {
+	fields := make([]byte, 28)
+	fields[7] = 1
+	return testMP4Box("Opus", fields)
+}
+
+func TestReadMP4Tracks(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e}
+	pps := []byte{0x68, 0xce}
+	samples := [][]byte{
+		{0, 0, 0, 2, 0x65, 0x88},
+		{0, 0, 0, 3, 0x41, 0x9a, 0x02},
+		{0, 0, 0, 3, 0x41, 0x9a, 0x04},
+	}
+	mdat := testMP4Box("mdat", samples...)
+	// the samples start after the mdat header
+	const offset = 8
+	video := testAVC1Entry(sps, pps)
+	stts := testMP4FullBox("stts", testU32(2, 2, 40, 1, 20))
+	stss := testMP4FullBox("stss", testU32(1, 1))
+	stsz := testMP4FullBox("stsz", testU32(0, 3, 6, 7, 7))
+	// two samples in the first chunk, one in the second
+	stsc := testMP4FullBox("stsc", testU32(2, 1, 2, 1, 2, 1, 1))
+	stco := testMP4FullBox("stco", testU32(2, offset, offset+13))
+	tests := []struct {
+		name   string
+		traks  [][]byte
+		tracks []*mp4Track
+		err    string
+	}{
+		{
+			name:  "h264",
+			traks: [][]byte{testMP4Track(video, stts, stss, stsz, stsc, stco)},
+			tracks: []*mp4Track{{
+				kind:      webrtc.RTPCodecTypeVideo,
+				mimeType:  webrtc.MimeTypeH264,
+				timescale: 1000,
+				offsets:   []uint64{offset, offset + 6, offset + 13},
+				sizes:     []uint32{6, 7, 7},
+				durations: []uint32{40, 40, 20},
+				syncs:     map[uint32]bool{1: true},
+				avc:       &avcConfig{lengthSize: 4, parameterSets: [][]byte{sps, pps}},
+			}},
+		},
+		{
+			name: "opus of one sample size and chunk, other codecs skipped",
+			traks: [][]byte{
+				testMP4Track(testMP4Box("mp4a", make([]byte, 28)), stts, stsz, stsc, stco),
+				testMP4Track(testOpusEntry(),
+					testMP4FullBox("stts", testU32(1, 2, 20)),
+					testMP4FullBox("stsz", testU32(3, 2)),
+					testMP4FullBox("stsc", testU32(1, 1, 2, 1)),
+					testMP4FullBox("co64", testU32(1, 0, offset)),
+				),
+			},
+			tracks: []*mp4Track{{
+				kind:      webrtc.RTPCodecTypeAudio,
+				mimeType:  webrtc.MimeTypeOpus,
+				timescale: 1000,
+				offsets:   []uint64{offset, offset + 3},
+				sizes:     []uint32{3, 3},
+				durations: []uint32{20, 20},
+			}},
+		},
+		{
+			name:  "no track to play",
+			traks: [][]byte{testMP4Track(testMP4Box("mp4a", make([]byte, 28)), stts, stsz, stsc, stco)},
+			err:   "mp4 has no h264 or opus track",
+		},
+		{
+			name:  "durations and sizes differ",
+			traks: [][]byte{testMP4Track(video, testMP4FullBox("stts", testU32(1, 2, 40)), stsz, stsc, stco)},
+			err:   "mp4 sample table invalid",
+		},
+		{
+			name: "b-frames",
+			traks: [][]byte{testMP4Track(video, stts, testMP4FullBox("ctts", testU32(2, 1, 40, 2, 0)),
+				stss, stsz, stsc, stco)},
+			err: "mp4 track has B-frames, encode it with -bf 0",
+		},
+		{
+			name:  "no stsc",
+			traks: [][]byte{testMP4Track(video, stts, stsz, stco)},
+			err:   "mp4 sample table invalid",
+		},
+		{
+			name:  "missing chunk",
+			traks: [][]byte{testMP4Track(video, stts, stsz, stsc, testMP4FullBox("stco", testU32(1, offset)))},
+			err:   "mp4 chunk table invalid",
+		},
+		{
+			name:  "avc1 without avcC",
+			traks: [][]byte{testMP4Track(testMP4Box("avc1", make([]byte, 78)), stts, stsz, stsc, stco)},
+			err:   "mp4 avc1 has no avcC",
+		},
+	}
+	for _, tt := range tests {
+		file := append(append([]byte{}, mdat...), testMP4Box("moov", tt.traks...)...)
+		tracks, err := readMP4Tracks(writeTestFile(t, "test.mp4", file))
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, want %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tracks, tt.tracks) {
+			t.Errorf("%s: %+v, want %+v", tt.name, tracks[0], tt.tracks[0])
+		}
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		file := append(append([]byte{}, mdat...), testMP4Box("moov", testMP4Track(video, stts, stss, stsz, stsc, stco))...)
+		if _, err := readMP4Tracks(writeTestFile(t, "test.mp4", file[:len(file)-10])); err == nil {
+			t.Error("truncated moov read")
+		}
+		// the moov goes first and the file ends in the last sample
+		moov := func(offset uint32) []byte {
+			return testMP4Box("moov", testMP4Track(video, stts, stss, stsz, stsc,
+				testMP4FullBox("stco", testU32(2, offset, offset+13))))
+		}
+		file = append(moov(uint32(len(moov(0))+8)), mdat...)
+		var s testSampleWriter
+		(&mp4Source{fileName: writeTestFile(t, "test.mp4", file[:len(file)-1])}).Run(context.Background(), &s, newMediaClockGroup())
+		if len(s.samples) != 2 {
+			t.Errorf("%d samples played of a truncated mdat, want 2", len(s.samples))
+		}
+	})
+}
+
+func TestMP4SourcePlay(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e}
+	pps := []byte{0x68, 0xce}
+	mdat := testMP4Box("mdat", []byte{0, 0, 0, 2, 0x65, 0x88}, []byte{0, 0, 0, 3, 0x41, 0x9a, 0x02})
+	file := append(mdat, testMP4Box("moov", testMP4Track(testAVC1Entry(sps, pps),
+		testMP4FullBox("stts", testU32(1, 2, 5)),
+		testMP4FullBox("stss", testU32(1, 1)),
+		testMP4FullBox("stsz", testU32(0, 2, 6, 7)),
+		testMP4FullBox("stsc", testU32(1, 1, 2, 1)),
+		testMP4FullBox("stco", testU32(1, 8)),
+	))...)
+	var s testSampleWriter
+	start := time.Now()
+	(&mp4Source{fileName: writeTestFile(t, "test.mp4", file)}).Run(context.Background(), &s, newMediaClockGroup())
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("played in %v, want 10ms", elapsed)
+	}
+	startCode := string(annexBStartCode)
+	want := []media.Sample{
+		// the sync sample gets the parameter sets of the avcC
+		{Data: []byte(startCode + string(sps) + startCode + string(pps) + startCode + "\x65\x88"), Duration: 5 * time.Millisecond},
+		{Data: []byte(startCode + "\x41\x9a\x02"), Duration: 5 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(s.samples, want) || strings.Join(s.mimeTypes, " ") != "video/H264 video/H264" {
+		t.Errorf("%v %x, want %x", s.mimeTypes, s.samples, want)
+	}
+}
+
+func TestMP4SourceLoop(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e}
+	pps := []byte{0x68, 0xce}
+	mdat := testMP4Box("mdat", []byte{0, 0, 0, 2, 0x65, 0x88}, []byte{0, 0, 0, 3, 0x41, 0x9a, 0x02}, []byte{0xf8, 0xff, 0xfe})
+	// 10ms of video and 20ms of audio
+	file := append(mdat, testMP4Box("moov",
+		testMP4Track(testAVC1Entry(sps, pps),
+			testMP4FullBox("stts", testU32(1, 2, 5)),
+			testMP4FullBox("stss", testU32(1, 1)),
+			testMP4FullBox("stsz", testU32(0, 2, 6, 7)),
+			testMP4FullBox("stsc", testU32(1, 1, 2, 1)),
+			testMP4FullBox("stco", testU32(1, 8)),
+		),
+		testMP4Track(testOpusEntry(),
+			testMP4FullBox("stts", testU32(1, 1, 20)),
+			testMP4FullBox("stsz", testU32(3, 1)),
+			testMP4FullBox("stsc", testU32(1, 1, 1, 1)),
+			testMP4FullBox("stco", testU32(1, 8+13)),
+		),
+	)...)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := testSampleWriter{onSample: func(n int) {
+		if n == 6 {
+			cancel()
+		}
+	}}
+	(&mp4Source{fileName: writeTestFile(t, "test.mp4", file), loop: true}).Run(ctx, &s, newMediaClockGroup())
+	var video, audio []media.Sample
+	for i, mimeType := range s.mimeTypes {
+		if mimeType == webrtc.MimeTypeH264 {
+			video = append(video, s.samples[i])
+		} else {
+			audio = append(audio, s.samples[i])
+		}
+	}
+	if len(video) < 3 || len(audio) < 2 {
+		t.Fatalf("%d video and %d audio samples, want two passes", len(video), len(audio))
+	}
+	// the video waits 10ms for the audio, two of its 5ms samples
+	for i, dropped := range []uint16{0, 0, 2} {
+		if video[i].PrevDroppedPackets != dropped {
+			t.Errorf("video sample %d skips %d samples, want %d", i, video[i].PrevDroppedPackets, dropped)
+		}
+	}
+	for i, sample := range audio {
+		if sample.PrevDroppedPackets != 0 {
+			t.Errorf("audio sample %d skips %d samples, want 0", i, sample.PrevDroppedPackets)
+		}
+	}
+}
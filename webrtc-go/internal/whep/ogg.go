@@ -0,0 +1,154 @@
+package whep
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	OGG_PAGE_HEADER_LEN        = 27
+	OGG_HEADER_TYPE_CONTINUED  = 0x01
+	OGG_LACING_VALUE_CONTINUED = 255
+	OPUS_CLOCK_RATE            = 48000
+)
+
+var errOggCapturePattern = errors.New("bad ogg capture pattern")
+
+// oggOpusReader reassembles the Opus packets of the first logical stream of
+// an Ogg file from the page segment tables (RFC 3533), a packet may span
+// several pages and a page may carry several packets. The OpusHead and
+// OpusTags header packets (RFC 7845) are skipped.
+type oggOpusReader struct {
+	in        io.Reader
+	serial    uint32
+	hasSerial bool
+	packets   [][]byte
+	partial   []byte
+	dropped   bool
+}
+
+func newOggOpusReader(in io.Reader) *oggOpusReader {
+	return &oggOpusReader{in: in}
+}
+
+func (o *oggOpusReader) NextPacket() ([]byte, error) {
+	for {
+		for len(o.packets) > 0 {
+			packet := o.packets[0]
+			o.packets = o.packets[1:]
+			if isOpusHeaderPacket(packet) {
+				continue
+			}
+			return packet, nil
+		}
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func isOpusHeaderPacket(packet []byte) bool {
+	if len(packet) < 8 {
+		return false
+	}
+	magic := string(packet[:8])
+	return magic == "OpusHead" || magic == "OpusTags"
+}
+
+func (o *oggOpusReader) readPage() error {
+	header := make([]byte, OGG_PAGE_HEADER_LEN)
+	if _, err := io.ReadFull(o.in, header); err != nil {
+		return err
+	}
+	if string(header[:4]) != "OggS" {
+		return errOggCapturePattern
+	}
+	headerType := header[5]
+	serial := binary.LittleEndian.Uint32(header[14:18])
+	segmentTable := make([]byte, header[26])
+	if _, err := io.ReadFull(o.in, segmentTable); err != nil {
+		return unexpectedEOF(err)
+	}
+	payloadSize := 0
+	for _, lacing := range segmentTable {
+		payloadSize += int(lacing)
+	}
+	payload := make([]byte, payloadSize)
+	if _, err := io.ReadFull(o.in, payload); err != nil {
+		return unexpectedEOF(err)
+	}
+	if !o.hasSerial {
+		o.serial, o.hasSerial = serial, true
+	} else if serial != o.serial {
+		return nil
+	}
+	if headerType&OGG_HEADER_TYPE_CONTINUED == 0 {
+		// a packet left open by the previous page was never finished
+		o.partial, o.dropped = nil, false
+	} else if o.partial == nil {
+		// the start of the continued packet was lost, drop its tail
+		o.dropped = true
+	}
+	for _, lacing := range segmentTable {
+		segment := payload[:lacing]
+		payload = payload[lacing:]
+		if !o.dropped {
+			o.partial = append(o.partial, segment...)
+		}
+		if lacing == OGG_LACING_VALUE_CONTINUED {
+			continue
+		}
+		if !o.dropped {
+			o.packets = append(o.packets, o.partial)
+		}
+		o.partial, o.dropped = nil, false
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// opusPacketSamples reads the TOC byte of an Opus packet (RFC 6716 3.1) and
+// returns its duration in 48 kHz samples.
+func opusPacketSamples(packet []byte) (int, error) {
+	if len(packet) < 1 {
+		return 0, errors.New("opus packet empty")
+	}
+	toc := packet[0]
+	config := toc >> 3
+	var frameSamples int
+	switch {
+	case config < 12: // SILK 10, 20, 40, 60 ms
+		frameSamples = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid 10, 20 ms
+		frameSamples = []int{480, 960}[config%2]
+	default: // CELT 2.5, 5, 10, 20 ms
+		frameSamples = []int{120, 240, 480, 960}[config%4]
+	}
+	frameCount := 1
+	switch toc & 0x03 {
+	case 1, 2:
+		frameCount = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, errors.New("opus packet missing frame count")
+		}
+		frameCount = int(packet[1] & 0x3f)
+	}
+	// a packet lasts at most 120 ms
+	if samples := frameSamples * frameCount; samples > 0 && samples <= 5760 {
+		return samples, nil
+	}
+	return 0, errors.New("opus packet duration invalid")
+}
+
+func opusSamplesDuration(samples int) time.Duration {
+	return time.Duration(samples) * time.Second / OPUS_CLOCK_RATE
+}
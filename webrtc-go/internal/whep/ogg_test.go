@@ -0,0 +1,156 @@
+package whep
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// testOggRawPage builds an Ogg page of the segment table and body as given,
+// the reader checks neither the CRC nor the granule position.
+func testOggRawPage(headerType, serial byte, segments, body []byte) []byte {
+	page := make([]byte, OGG_PAGE_HEADER_LEN)
+	copy(page, "OggS")
+	page[5] = headerType
+	page[14] = serial
+	page[26] = byte(len(segments))
+	page = append(page, segments...)
+	return append(page, body...)
+}
+
+// testOggPage builds a page of stream 1 ending with the last of the packets.
+func testOggPage(headerType byte, packets ...[]byte) []byte {
+	var segments, body []byte
+	for _, packet := range packets {
+		n := len(packet)
+		for ; n >= OGG_LACING_VALUE_CONTINUED; n -= OGG_LACING_VALUE_CONTINUED {
+			segments = append(segments, OGG_LACING_VALUE_CONTINUED)
+		}
+		segments = append(segments, byte(n))
+		body = append(body, packet...)
+	}
+	return testOggRawPage(headerType, 1, segments, body)
+}
+
+func TestOggOpusReader(t *testing.T) {
+	head := []byte("OpusHead\x01\x02\x38\x01\x80\xbb\x00\x00\x00\x00\x00")
+	tags := []byte("OpusTags\x00\x00\x00\x00\x00\x00\x00\x00")
+	packet := func(b byte, n int) []byte {
+		return bytes.Repeat([]byte{b}, n)
+	}
+	join := func(pages ...[]byte) []byte {
+		return bytes.Join(pages, nil)
+	}
+	tests := []struct {
+		name    string
+		file    []byte
+		packets [][]byte
+		err     error
+	}{
+		{
+			name:    "headers skipped",
+			file:    join(testOggPage(0x02, head), testOggPage(0, tags), testOggPage(0, packet(1, 3), packet(2, 4))),
+			packets: [][]byte{packet(1, 3), packet(2, 4)},
+			err:     io.EOF,
+		},
+		{
+			name:    "packet of 255 bytes",
+			file:    testOggPage(0, packet(1, 255), packet(2, 1)),
+			packets: [][]byte{packet(1, 255), packet(2, 1)},
+			err:     io.EOF,
+		},
+		{
+			name: "packet across pages",
+			file: join(
+				testOggRawPage(0, 1, []byte{3, 255}, join(packet(1, 3), packet(2, 255))),
+				testOggRawPage(OGG_HEADER_TYPE_CONTINUED, 1, []byte{10}, packet(2, 10)),
+			),
+			packets: [][]byte{packet(1, 3), packet(2, 265)},
+			err:     io.EOF,
+		},
+		{
+			name:    "continued packet without its start",
+			file:    testOggRawPage(OGG_HEADER_TYPE_CONTINUED, 1, []byte{10, 2}, join(packet(1, 10), packet(2, 2))),
+			packets: [][]byte{packet(2, 2)},
+			err:     io.EOF,
+		},
+		{
+			name: "unfinished packet before a new one",
+			file: join(
+				testOggRawPage(0, 1, []byte{255}, packet(1, 255)),
+				testOggPage(0, packet(2, 2)),
+			),
+			packets: [][]byte{packet(2, 2)},
+			err:     io.EOF,
+		},
+		{
+			name:    "other logical stream",
+			file:    join(testOggPage(0, packet(1, 1)), testOggRawPage(0, 2, []byte{1}, packet(2, 1)), testOggPage(0, packet(3, 1))),
+			packets: [][]byte{packet(1, 1), packet(3, 1)},
+			err:     io.EOF,
+		},
+		{
+			name:    "truncated header",
+			file:    join(testOggPage(0, packet(1, 1)), testOggPage(0, packet(2, 1))[:OGG_PAGE_HEADER_LEN-1]),
+			packets: [][]byte{packet(1, 1)},
+			err:     io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "truncated body",
+			file:    testOggPage(0, packet(1, 4))[:OGG_PAGE_HEADER_LEN+1+2],
+			packets: nil,
+			err:     io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "bad capture pattern",
+			file:    append([]byte("OggZ"), testOggPage(0, packet(1, 1))[4:]...),
+			packets: nil,
+			err:     errOggCapturePattern,
+		},
+	}
+	for _, tt := range tests {
+		reader := newOggOpusReader(bytes.NewReader(tt.file))
+		var packets [][]byte
+		var err error
+		for {
+			var packet []byte
+			if packet, err = reader.NextPacket(); err != nil {
+				break
+			}
+			packets = append(packets, packet)
+		}
+		if err != tt.err || !reflect.DeepEqual(packets, tt.packets) {
+			t.Errorf("%s: %d packets %v, want %d packets %v", tt.name, len(packets), err, len(tt.packets), tt.err)
+		}
+	}
+}
+
+func TestOpusPacketSamples(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  []byte
+		samples int
+		err     bool
+	}{
+		{"silk 10ms", []byte{0x00}, 480, false},
+		{"silk 60ms", []byte{0x18}, 2880, false},
+		{"hybrid 20ms", []byte{0x68}, 960, false},
+		{"celt 2.5ms", []byte{0x80}, 120, false},
+		{"celt 20ms", []byte{0xf8}, 960, false},
+		{"two equal frames", []byte{0xf9}, 1920, false},
+		{"two different frames", []byte{0xfa}, 1920, false},
+		{"arbitrary frames", []byte{0xfb, 0x03}, 2880, false},
+		{"arbitrary frames at 120ms", []byte{0x1b, 0x02}, 5760, false},
+		{"over 120ms", []byte{0x1b, 0x03}, 0, true},
+		{"zero frames", []byte{0xfb, 0x00}, 0, true},
+		{"missing frame count", []byte{0xfb}, 0, true},
+		{"empty", nil, 0, true},
+	}
+	for _, tt := range tests {
+		samples, err := opusPacketSamples(tt.packet)
+		if (err != nil) != tt.err || samples != tt.samples {
+			t.Errorf("%s: %d %v, want %d error %v", tt.name, samples, err, tt.samples, tt.err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package whep
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+const PROBLEM_CONTENT_TYPE = "application/problem+json"
+
+var (
+	errBadRequest      = errors.New("bad request")
+	errSessionNotExist = errors.New("session not exist")
+	errStreamConflict  = errors.New("whip client already exist")
+	errUnacceptableSDP = errors.New("unacceptable sdp")
+	errAtCapacity      = errors.New("server at capacity")
+)
+
+// problem is an RFC 9457 problem details body, the detail carries the
+// underlying pion error so clients can tell what went wrong.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// wrapError tags err with the sentinel that selects its HTTP status.
+func wrapError(sentinel, err error) error {
+	return fmt.Errorf("%w: %v", sentinel, err)
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errSessionNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, errStreamConflict):
+		return http.StatusConflict
+	case errors.Is(err, errETagMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errUnacceptableSDP):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errAtCapacity):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errRequestTooLarge):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="whep"`)
+	}
+	w.Header().Set("Content-Type", PROBLEM_CONTENT_TYPE)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	writeRetryAfter(w, err)
+	writeProblem(w, r, errorStatus(err), err.Error())
+}
+
+// writeMethodNotAllowed answers 405 with the methods the endpoint or the
+// session resource supports.
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allow string) {
+	w.Header().Set("Allow", allow)
+	writeProblem(w, r, http.StatusMethodNotAllowed, r.Method+" not allowed, use "+allow)
+}
+
+func hasContentType(r *http.Request, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == contentType
+}
@@ -0,0 +1,93 @@
+package whep
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+const DEFAULT_PROFILE = "playout"
+
+// profile is the set of transport features of a session. A session takes
+// the profile named by ?profile=, or the default one, and each feature can
+// then be switched with ?<feature>=enable|disable, <feature> being its YAML
+// key, e.g. /live/livestream.whep?profile=nack&playout_delay=enable.
+type profile struct {
+	NACK         bool `yaml:"nack"`
+	RTX          bool `yaml:"rtx"`
+	FlexFEC      bool `yaml:"flexfec"`
+	RED          bool `yaml:"red"`
+	Pacer        bool `yaml:"pacer"`
+	TWCC         bool `yaml:"twcc"`
+	GCC          bool `yaml:"gcc"`
+	PlayoutDelay bool `yaml:"playout_delay"`
+}
+
+// defaultProfiles are the feature sets of the former whep-* binaries, the
+// profiles of the configuration file are added to them.
+var defaultProfiles = map[string]profile{
+	"whep":    {NACK: true, TWCC: true},
+	"nack":    {NACK: true, RTX: true, TWCC: true},
+	"flexfec": {NACK: true, RTX: true, FlexFEC: true, TWCC: true},
+	"cc":      {NACK: true, RTX: true, FlexFEC: true, TWCC: true, GCC: true},
+	"pacer":   {NACK: true, RTX: true, FlexFEC: true, Pacer: true, TWCC: true},
+	"red":     {NACK: true, RTX: true, FlexFEC: true, Pacer: true, TWCC: true, RED: true},
+	"playout": {NACK: true, RTX: true, FlexFEC: true, Pacer: true, TWCC: true, RED: true, PlayoutDelay: true},
+}
+
+func (p *profile) features() map[string]*bool {
+	return map[string]*bool{
+		"nack":          &p.NACK,
+		"rtx":           &p.RTX,
+		"flexfec":       &p.FlexFEC,
+		"red":           &p.RED,
+		"pacer":         &p.Pacer,
+		"twcc":          &p.TWCC,
+		"gcc":           &p.GCC,
+		"playout_delay": &p.PlayoutDelay,
+	}
+}
+
+// validate reports the features that cannot work without another one.
+func (p *profile) validate() error {
+	if p.RTX && !p.NACK {
+		return fmt.Errorf("rtx requires nack")
+	}
+	if p.GCC && !p.TWCC {
+		return fmt.Errorf("gcc requires twcc")
+	}
+	return nil
+}
+
+// sessionProfile resolves the profile of the request url.
+func (h *whepHandler) sessionProfile(url *url.URL) (string, profile, error) {
+	query := url.Query()
+	name := query.Get("profile")
+	if name == "" {
+		name = h.defaultProfile
+	}
+	p, ok := h.profiles[name]
+	if !ok {
+		names := make([]string, 0, len(h.profiles))
+		for name := range h.profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", p, fmt.Errorf("profile %q not exist, profiles are %v", name, names)
+	}
+	for feature, enabled := range p.features() {
+		switch query.Get(feature) {
+		case "":
+		case "enable":
+			*enabled = true
+		case "disable":
+			*enabled = false
+		default:
+			return "", p, fmt.Errorf("%s=%s is not enable or disable", feature, query.Get(feature))
+		}
+	}
+	if err := p.validate(); err != nil {
+		return "", p, err
+	}
+	return name, p, nil
+}
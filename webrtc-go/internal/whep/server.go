@@ -0,0 +1,631 @@
+package whep
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	HTTP_ADDR           = ":8082"
+	CANDIDATE           = "127.0.0.1"
+	ICE_UDP_PORT        = 15060
+	ICE_TCP_PORT        = 15060
+	AUDIO_FILE_NAME     = "../output.ogg"
+	VIDEO_FILE_NAME     = "../output.h264"
+	OGG_PAGE_DURATION   = time.Millisecond * 20
+	H264_FRAME_DURATION = time.Millisecond * 41
+	VOD_LOOP            = true
+	CONNECT_TIMEOUT     = time.Second * 15
+	// the pion defaults, an abandoned session is closed once ICE failed
+	ICE_DISCONNECTED_TIMEOUT = time.Second * 5
+	ICE_FAILED_TIMEOUT       = time.Second * 25
+)
+
+var (
+	defaultAudioCodecs = []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:  webrtc.MimeTypeOpus,
+				ClockRate: 48000,
+			},
+			PayloadType: 112,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeRed,
+				ClockRate:   48000,
+				SDPFmtpLine: "112/112",
+			},
+			PayloadType: 64,
+		},
+	}
+
+	defaultVideoCodecs = []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeH264,
+				ClockRate:   90000,
+				SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			},
+			PayloadType: 96,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    "video/rtx",
+				ClockRate:   90000,
+				SDPFmtpLine: "apt=96",
+			},
+			PayloadType: 97,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeH265,
+				ClockRate:   90000,
+				SDPFmtpLine: "level-id=93;profile-id=1;tier-flag=0;tx-mode=SRST",
+			},
+			PayloadType: 102,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    "video/rtx",
+				ClockRate:   90000,
+				SDPFmtpLine: "apt=102",
+			},
+			PayloadType: 103,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:  webrtc.MimeTypeVP8,
+				ClockRate: 90000,
+			},
+			PayloadType: 98,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    "video/rtx",
+				ClockRate:   90000,
+				SDPFmtpLine: "apt=98",
+			},
+			PayloadType: 99,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeVP9,
+				ClockRate:   90000,
+				SDPFmtpLine: "profile-id=0",
+			},
+			PayloadType: 100,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    "video/rtx",
+				ClockRate:   90000,
+				SDPFmtpLine: "apt=100",
+			},
+			PayloadType: 101,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:  webrtc.MimeTypeAV1,
+				ClockRate: 90000,
+			},
+			PayloadType: 45,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    "video/rtx",
+				ClockRate:   90000,
+				SDPFmtpLine: "apt=45",
+			},
+			PayloadType: 46,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    "video/flexfec-03",
+				ClockRate:   90000,
+				SDPFmtpLine: "repair-window=10000000",
+			},
+			PayloadType: 49,
+		},
+	}
+	defaultInterceptors = interceptorConfig{
+		NACKGeneratorSize:     512,
+		NACKGeneratorInterval: time.Millisecond * 40,
+		NACKResponderSize:     1024,
+		PlayoutDelayMin:       500 * time.Millisecond,
+		PlayoutDelayMax:       1500 * time.Millisecond,
+		GCCInitialBitrate:     1000000,
+	}
+	defaultAdmission = admissionConfig{
+		MaxSessions:   500,
+		MaxIPSessions: 50,
+		RequestRate:   20,
+		RequestBurst:  40,
+		MaxSDPSize:    64 << 10,
+		RetryAfter:    5 * time.Second,
+	}
+	defaultGOPCache = gopCacheConfig{
+		MaxFrames:    150,
+		MaxBytes:     16 << 20,
+		BurstSpeed:   4,
+		BurstBitrate: 20000000,
+	}
+)
+
+type whepHandler struct {
+	httpAddr   string
+	iceUDPPort int
+	iceTCPPort int
+
+	iceUDPMux     ice.UDPMux
+	iceTCPMux     ice.TCPMux
+	iceNAT1To1IPs []string
+
+	source       *sourceConfig
+	paths        map[string]*sourceConfig
+	audioCodecs  []webrtc.RTPCodecParameters
+	videoCodecs  []webrtc.RTPCodecParameters
+	interceptors interceptorConfig
+	gopCache     gopCacheConfig
+	// a session not connected this long after its answer is removed
+	connectTimeout         time.Duration
+	iceDisconnectedTimeout time.Duration
+	iceFailedTimeout       time.Duration
+
+	profiles       map[string]profile
+	defaultProfile string
+
+	tokenValidators []tokenValidator
+	metricsToken    string
+	allowOrigins    []string
+	iceServers      []webrtc.ICEServer
+
+	mapWhepClients map[string]*whepClient
+	mapWhipClients map[string]*whipClient
+	mapStreams     map[string]*stream
+	locker         sync.RWMutex
+	metrics        *metrics
+	admission      *admission
+	// the goroutines writing samples, waited for by Shutdown
+	senders sync.WaitGroup
+}
+
+// newPeerConnection also returns the GCC estimator when the profile has GCC,
+// and the stats counters.
+func (h *whepHandler) newPeerConnection(url *url.URL, p profile, isSendSide bool) (*webrtc.PeerConnection, cc.BandwidthEstimator, *statsInterceptor, error) {
+	iceProtocolPolicy := webrtc.ICEProtocolPolicyPreferUDP
+	if url.Query().Get("transport") == "tcp" {
+		iceProtocolPolicy = webrtc.ICEProtocolPolicyPreferTCP
+	}
+	var estimator cc.BandwidthEstimator
+	var stats *statsInterceptor
+	pc, err := createPeerConnection(&TransportParams{
+		ICEUDPMux:              h.iceUDPMux,
+		ICETCPMux:              h.iceTCPMux,
+		ICELite:                true,
+		ICEProtocolPolicy:      iceProtocolPolicy,
+		ICEDisconnectedTimeout: h.iceDisconnectedTimeout,
+		ICEFailedTimeout:       h.iceFailedTimeout,
+		NAT1To1IPs:             h.iceNAT1To1IPs,
+		EnabledAudioCodecs:     h.audioCodecs,
+		EnabledVideoCodecs:     h.videoCodecs,
+		Profile:                p,
+		IsSendSide:             isSendSide,
+		NACKGeneratorSize:      h.interceptors.NACKGeneratorSize,
+		NACKGeneratorInterval:  h.interceptors.NACKGeneratorInterval,
+		NACKResponderSize:      h.interceptors.NACKResponderSize,
+		PlayoutDelayMin:        h.interceptors.PlayoutDelayMin,
+		PlayoutDelayMax:        h.interceptors.PlayoutDelayMax,
+		GCCInitialBitrate:      h.interceptors.GCCInitialBitrate,
+		OnBandwidthEstimator: func(e cc.BandwidthEstimator) {
+			estimator = e
+		},
+		OnStatsInterceptor: func(s *statsInterceptor) {
+			stats = s
+		},
+	})
+	return pc, estimator, stats, err
+}
+
+func (h *whepHandler) createWhepClient(url *url.URL, offerStr, clientIP string) (string, string, error) {
+	setupStart := time.Now()
+	name := streamName(url.Path)
+	// the session is admitted and negotiated without h.locker, which is only
+	// taken to add it, so a burst over the limits or a slow offer does not
+	// hold up the other requests
+	if err := h.admission.admit(name, clientIP); err != nil {
+		return "", "", err
+	}
+	s := h.joinStream(name)
+	added := false
+	var pc *webrtc.PeerConnection
+	var c *whepClient
+	defer func() {
+		if added {
+			return
+		}
+		if c != nil {
+			c.closing()
+		}
+		if pc != nil {
+			pc.Close()
+		}
+		h.locker.Lock()
+		h.leaveStream(s)
+		h.locker.Unlock()
+		h.admission.leave(name, clientIP)
+	}()
+	resource := newResourcePath(url.Path)
+	profileName, p, err := h.sessionProfile(url)
+	if err != nil {
+		return "", "", wrapError(errBadRequest, err)
+	}
+	// ?layer= names a simulcast layer, it is a rendition of the stream too
+	pinnedRendition := url.Query().Get("rendition")
+	if pinnedRendition == "" {
+		pinnedRendition = url.Query().Get("layer")
+	}
+	if pinnedRendition != "" && !s.HasRendition(pinnedRendition) {
+		return "", "", wrapError(errBadRequest, fmt.Errorf("rendition %q not exist", pinnedRendition))
+	}
+	videoMimeType, err := selectVideoCodec(offerStr, s.VideoMimeTypes())
+	if err != nil {
+		return "", "", wrapError(errUnacceptableSDP, err)
+	}
+	pc, estimator, stats, err := h.newPeerConnection(url, p, true)
+	if err != nil {
+		return "", "", err
+	}
+	c, err = newWhepClient(pc, s, videoMimeType, pinnedRendition)
+	if err != nil {
+		return "", "", err
+	}
+	c.profile = profileName
+	c.estimator = estimator
+	c.stats = stats
+	c.clientIP = clientIP
+	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		log.Println("pc state change:", connectionState.String())
+	})
+	// samples written before DTLS is up are dropped, the GOP replayed to the
+	// subscriber waits for the peer connection to be connected
+	var setupOnce sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			if !c.streaming() {
+				return
+			}
+			setupOnce.Do(func() {
+				h.metrics.observeSetup(time.Since(setupStart))
+			})
+			s.Activate(c)
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			h.deleteWhepClient(resource)
+		}
+	})
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offerStr,
+	}); err != nil {
+		return "", "", wrapError(errUnacceptableSDP, err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", "", wrapError(errUnacceptableSDP, err)
+	}
+	pc.OnICECandidate(c.trickle.onCandidate)
+	if err = pc.SetLocalDescription(answer); err != nil {
+		return "", "", err
+	}
+	// answered with the candidates gathered so far, the next ones are sent
+	// back to the PATCH requests of the client
+	c.trickle.reset()
+	answerSDP := pc.LocalDescription().SDP
+	h.locker.Lock()
+	s.Attach(c)
+	h.mapWhepClients[resource] = c
+	added = true
+	h.leaveStream(s)
+	h.locker.Unlock()
+	h.metrics.sessionCreated(profileName)
+	if pinnedRendition == "" && estimator != nil {
+		c.abr = newABRController(c, estimator)
+		c.abr.Run()
+	}
+	c.connecting(h.connectTimeout, func() {
+		log.Println("WHEP Client connect timeout:", resource)
+		h.deleteWhepClient(resource)
+	})
+	rendition, _ := c.Rendition()
+	log.Println("Add WHEP Client:", resource, videoMimeType, profileName, rendition)
+	return resource, answerSDP, nil
+}
+
+func (h *whepHandler) deleteWhepClient(resource string) error {
+	h.locker.Lock()
+	c, ok := h.mapWhepClients[resource]
+	if !ok {
+		h.locker.Unlock()
+		return errSessionNotExist
+	}
+	c.closing()
+	c.stream.Detach(c)
+	h.releaseStream(c.stream)
+	delete(h.mapWhepClients, resource)
+	h.admission.leave(c.stream.name, c.clientIP)
+	h.locker.Unlock()
+	// GetStats and Close wait on the peer connection, keep them out of h.locker
+	h.metrics.sessionClosed(c.Stats(resource))
+	c.pc.Close()
+	log.Println("Remove WHEP Client:", resource)
+	return nil
+}
+
+func (h *whepHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if originHdr := r.Header.Get("Origin"); originHdr != "" && h.allowOrigin(originHdr) {
+		w.Header().Set("Access-Control-Allow-Origin", originHdr)
+		w.Header().Set("Vary", "Origin")
+	}
+	endpoint, sessionID := splitResourcePath(r.URL.Path)
+	allow := "POST, OPTIONS"
+	switch {
+	case r.URL.Path == STATS_PATH, r.URL.Path == METRICS_PATH:
+		allow = "GET, OPTIONS"
+	case sessionID != "" && isWhipPath(endpoint):
+		allow = "PATCH, DELETE, OPTIONS"
+	case sessionID != "":
+		allow = "GET, PATCH, DELETE, OPTIONS"
+	}
+	// the scraper has its own token and is not rate limited with the players
+	if r.URL.Path == METRICS_PATH && r.Method == http.MethodGet {
+		if err := h.authorizeMetrics(r); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		h.writeMetrics(w)
+		return
+	}
+	// a CORS preflight carries no Authorization, every other request is
+	// authorized, a plain OPTIONS too since it gets the TURN credentials
+	if !isPreflight(r) {
+		if err := h.admission.allow(clientIP(r), time.Now()); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		action := ACTION_PLAY
+		if isWhipPath(endpoint) {
+			action = ACTION_PUBLISH
+		}
+		if err := h.authorize(r, streamName(endpoint), action); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Path == STATS_PATH {
+			writeJSON(w, h.serverStats())
+			return
+		}
+		if sessionID == "" || isWhipPath(endpoint) {
+			writeMethodNotAllowed(w, r, allow)
+			return
+		}
+		stats, err := h.sessionStats(r.URL.Path)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, stats)
+		return
+	case http.MethodPost:
+		if r.URL.Path == STATS_PATH || r.URL.Path == METRICS_PATH || sessionID != "" {
+			writeMethodNotAllowed(w, r, allow)
+			return
+		}
+		if !hasContentType(r, "application/sdp") {
+			w.Header().Set("Accept-Post", "application/sdp")
+			writeProblem(w, r, http.StatusUnsupportedMediaType, "offer must be application/sdp")
+			return
+		}
+		scheme := "http://"
+		if r.TLS != nil {
+			scheme = "https://"
+		}
+		offer, err := h.admission.readSDP(w, r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		var resource, answer string
+		if isWhipPath(endpoint) {
+			resource, answer, err = h.createWhipClient(r.URL, string(offer), clientIP(r))
+		} else {
+			resource, answer, err = h.createWhepClient(r.URL, string(offer), clientIP(r))
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "Location, ETag, Accept-Patch, Link")
+		w.Header().Set("Location", strings.Join([]string{scheme, r.Host, resource}, ""))
+		w.Header().Set("ETag", sessionETag(answer))
+		w.Header().Set("Accept-Patch", SDP_FRAG_CONTENT_TYPE)
+		h.writeICEServerLinks(w)
+		w.Header().Set("Content-Type", "application/sdp")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(answer))
+		return
+	case http.MethodDelete:
+		if sessionID == "" {
+			writeMethodNotAllowed(w, r, allow)
+			return
+		}
+		deleteClient := h.deleteWhepClient
+		if isWhipPath(endpoint) {
+			deleteClient = h.deleteWhipClient
+		}
+		if err := deleteClient(r.URL.Path); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	case http.MethodPatch:
+		if sessionID == "" {
+			writeMethodNotAllowed(w, r, allow)
+			return
+		}
+		if !hasContentType(r, SDP_FRAG_CONTENT_TYPE) {
+			w.Header().Set("Accept-Patch", SDP_FRAG_CONTENT_TYPE)
+			writeProblem(w, r, http.StatusUnsupportedMediaType, "patch must be "+SDP_FRAG_CONTENT_TYPE)
+			return
+		}
+		frag, err := h.admission.readSDP(w, r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		etag, answerFrag, err := h.patchClient(r.URL.Path, r.Header.Get("If-Match"), string(frag))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
+		w.Header().Set("ETag", etag)
+		if answerFrag == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", SDP_FRAG_CONTENT_TYPE)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(answerFrag))
+		return
+	case http.MethodOptions:
+		if isPreflight(r) {
+			w.Header().Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+		} else {
+			w.Header().Set("Access-Control-Expose-Headers", "Link")
+			h.writeICEServerLinks(w)
+		}
+		if reqHeadersHdr := r.Header.Get("Access-Control-Request-Headers"); reqHeadersHdr != "" {
+			w.Header().Set("Access-Control-Allow-Headers", reqHeadersHdr)
+		}
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeMethodNotAllowed(w, r, allow)
+		return
+	}
+}
+
+// isPreflight reports whether r is a CORS preflight rather than an OPTIONS
+// request of the client itself.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (h *whepHandler) Init() error {
+	h.mapWhepClients = make(map[string]*whepClient)
+	h.mapWhipClients = make(map[string]*whipClient)
+	h.mapStreams = make(map[string]*stream)
+	h.metrics = newMetrics()
+	if err := h.openSources(); err != nil {
+		return err
+	}
+	if h.iceUDPPort != 0 {
+		udplistener, err := net.ListenUDP("udp", &net.UDPAddr{
+			IP:   net.IP{0, 0, 0, 0},
+			Port: h.iceUDPPort,
+		})
+		if err != nil {
+			return err
+		}
+		h.iceUDPMux = webrtc.NewICEUDPMux(nil, udplistener)
+	}
+	if h.iceTCPPort != 0 {
+		tcplistener, err := net.ListenTCP("tcp", &net.TCPAddr{
+			IP:   net.IP{0, 0, 0, 0},
+			Port: h.iceTCPPort,
+		})
+		if err != nil {
+			return err
+		}
+		h.iceTCPMux = webrtc.NewICETCPMux(nil, tcplistener, 20)
+	}
+
+	return nil
+}
+
+// Main runs the server with the configuration of the command line until
+// SIGINT or SIGTERM, defaultProfile is the profile of the sessions when
+// neither the configuration nor ?profile= names one.
+func Main(defaultProfile string) {
+	c, err := loadConfig(os.Args[1:], defaultProfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h := &whepHandler{
+		httpAddr:               c.HTTPAddr,
+		iceNAT1To1IPs:          c.Candidates,
+		iceUDPPort:             c.ICEUDPPort,
+		iceTCPPort:             c.ICETCPPort,
+		source:                 &c.Source,
+		paths:                  c.Paths,
+		audioCodecs:            rtpCodecs(c.Codecs.Audio, defaultAudioCodecs),
+		videoCodecs:            rtpCodecs(c.Codecs.Video, defaultVideoCodecs),
+		interceptors:           c.Interceptors,
+		gopCache:               c.GOPCache,
+		admission:              newAdmission(c.Admission),
+		connectTimeout:         c.ConnectTimeout,
+		iceDisconnectedTimeout: c.ICEDisconnectedTimeout,
+		iceFailedTimeout:       c.ICEFailedTimeout,
+		tokenValidators:        c.tokenValidators(),
+		allowOrigins:           c.AllowOrigins,
+		iceServers:             c.ICEServers,
+		profiles:               c.profiles(),
+		defaultProfile:         c.DefaultProfile,
+	}
+	if err := h.Init(); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("whep server running", h.httpAddr, "default profile", h.defaultProfile)
+	srv := &http.Server{Addr: h.httpAddr, Handler: h}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+	stop()
+	log.Println("whep server shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	// no new session once the listener is closed and the in-flight
+	// requests are done
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+	if err := h.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+	log.Println("whep server stopped")
+}
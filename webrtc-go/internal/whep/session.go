@@ -0,0 +1,30 @@
+package whep
+
+import (
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Every POST to an endpoint such as "/live/livestream.whep" creates a session
+// resource "/live/livestream.whep/<session-id>", DELETE and PATCH requests
+// address that resource so many clients can share the same endpoint.
+
+func isEndpointPath(p string) bool {
+	return strings.HasSuffix(p, ".whep") || strings.HasSuffix(p, ".whip")
+}
+
+// splitResourcePath splits a session resource into its endpoint and session
+// id, the session id is empty when p is the endpoint itself.
+func splitResourcePath(p string) (endpoint, sessionID string) {
+	dir, file := path.Split(p)
+	if dir = strings.TrimSuffix(dir, "/"); isEndpointPath(dir) {
+		return dir, file
+	}
+	return p, ""
+}
+
+func newResourcePath(endpoint string) string {
+	return path.Join(endpoint, uuid.NewString())
+}
@@ -0,0 +1,84 @@
+package whep
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// SHUTDOWN_TIMEOUT bounds the graceful shutdown, the in-flight requests and
+// then the goroutines still writing samples are waited for at most this long.
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// goodbye sends an RTCP BYE for the tracks of the subscriber, so the browser
+// ends them at once instead of freezing until the ICE timeout.
+func (c *whepClient) goodbye() {
+	if c.pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		return
+	}
+	var ssrcs []uint32
+	for _, sender := range c.pc.GetSenders() {
+		for _, encoding := range sender.GetParameters().Encodings {
+			ssrcs = append(ssrcs, uint32(encoding.SSRC))
+		}
+	}
+	if len(ssrcs) == 0 {
+		return
+	}
+	if err := c.pc.WriteRTCP([]rtcp.Packet{&rtcp.Goodbye{Sources: ssrcs, Reason: "shutdown"}}); err != nil {
+		log.Println(err)
+	}
+}
+
+// Shutdown closes every session once the HTTP server no longer accepts new
+// ones: the subscribers get an RTCP BYE and a DTLS close_notify from
+// pc.Close, then the publishers are closed. It waits for the sources, bursts
+// and publishers to stop writing, or for ctx to be done, and closes the ICE
+// muxes last.
+func (h *whepHandler) Shutdown(ctx context.Context) error {
+	h.locker.RLock()
+	whepClients := make(map[string]*whepClient, len(h.mapWhepClients))
+	for resource, c := range h.mapWhepClients {
+		whepClients[resource] = c
+	}
+	whipResources := make([]string, 0, len(h.mapWhipClients))
+	for resource := range h.mapWhipClients {
+		whipResources = append(whipResources, resource)
+	}
+	h.locker.RUnlock()
+	// the subscribers go first, a publisher leaving would restart the file
+	// source of their stream
+	for resource, c := range whepClients {
+		c.goodbye()
+		h.deleteWhepClient(resource)
+	}
+	for _, resource := range whipResources {
+		h.deleteWhipClient(resource)
+	}
+	done := make(chan struct{})
+	go func() {
+		h.senders.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.Println("senders still running:", err)
+	}
+	if h.iceUDPMux != nil {
+		if err := h.iceUDPMux.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	if h.iceTCPMux != nil {
+		if err := h.iceTCPMux.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,291 @@
+package whep
+
+import (
+	"context"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// fileSource plays an H264 Annex-B file and an Ogg/Opus file from disk, in
+// loop mode both files are reopened once both reached EOF. The samples keep
+// going to the same subscriber tracks, so RTP sequence numbers and timestamps
+// stay monotonic across the wrap.
+type fileSource struct {
+	videoFileName     string
+	audioFileName     string
+	oggPageDuration   time.Duration
+	h264FrameDuration time.Duration
+	loop              bool
+}
+
+// MEDIA_CLOCK_MAX_LAG is how late the clock may fall behind before it is
+// reset instead of bursting the missed samples.
+const MEDIA_CLOCK_MAX_LAG = time.Second
+
+// mediaClock paces samples against the monotonic clock by their media time
+// instead of a ticker, so rounding and scheduling delays never add up.
+type mediaClock struct {
+	start   time.Time
+	elapsed time.Duration
+	gap     time.Duration
+}
+
+func newMediaClock() *mediaClock {
+	return &mediaClock{start: time.Now()}
+}
+
+// Wait advances the media time by d and blocks until it is due.
+func (c *mediaClock) Wait(ctx context.Context, d time.Duration) error {
+	c.elapsed += d
+	delay := time.Until(c.start.Add(c.elapsed))
+	if delay < -MEDIA_CLOCK_MAX_LAG {
+		c.start = time.Now().Add(-c.elapsed)
+		delay = 0
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Skip stamps the sample with the gap left by alignMediaClocks as dropped
+// samples of its duration, so its RTP timestamp jumps over the gap and keeps
+// following the media time. The sequence number only skips one per dropped
+// sample, not one per packet the samples would have been split into. The
+// remainder shorter than the sample is left for the next gap.
+func (c *mediaClock) Skip(sample *media.Sample) {
+	if c.gap < sample.Duration || sample.Duration <= 0 {
+		return
+	}
+	dropped := c.gap / sample.Duration
+	if dropped > math.MaxUint16 {
+		dropped = math.MaxUint16
+	}
+	sample.PrevDroppedPackets = uint16(dropped)
+	c.gap -= dropped * sample.Duration
+}
+
+// alignMediaClocks moves the clocks that ended a pass early forward to the
+// one that ended last, so the tracks of looping sources start the next pass
+// together.
+func alignMediaClocks(clocks []*mediaClock) {
+	var end time.Time
+	for _, c := range clocks {
+		if due := c.start.Add(c.elapsed); due.After(end) {
+			end = due
+		}
+	}
+	for _, c := range clocks {
+		gap := end.Sub(c.start.Add(c.elapsed))
+		c.elapsed += gap
+		c.gap += gap
+	}
+}
+
+// mediaClockGroup loops the sources of a stream together. Every source
+// plays a pass on clocks of the group and waits in Rewind until the others
+// ended theirs too, then the clocks are aligned to the one that ended last,
+// so renditions in other files never drift from the main audio.
+type mediaClockGroup struct {
+	locker  sync.Mutex
+	start   time.Time
+	clocks  []*mediaClock
+	members int
+	waiting int
+	rewound chan struct{}
+}
+
+// newMediaClockGroup creates the group of a single source, Add makes room
+// for more.
+func newMediaClockGroup() *mediaClockGroup {
+	return &mediaClockGroup{start: time.Now(), members: 1, rewound: make(chan struct{})}
+}
+
+// Add counts n more sources in the group, it is called before they start.
+func (g *mediaClockGroup) Add(n int) {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+	g.members += n
+}
+
+// NewClocks creates n clocks started with the group for the tracks of a
+// source.
+func (g *mediaClockGroup) NewClocks(n int) []*mediaClock {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+	clocks := make([]*mediaClock, n)
+	for i := range clocks {
+		clocks[i] = &mediaClock{start: g.start}
+	}
+	g.clocks = append(g.clocks, clocks...)
+	return clocks
+}
+
+// Rewind waits until every source of the group ended its pass, the clocks
+// are then aligned for the next one.
+func (g *mediaClockGroup) Rewind(ctx context.Context) error {
+	g.locker.Lock()
+	g.waiting++
+	rewound := g.rewound
+	g.rewindIfAll()
+	g.locker.Unlock()
+	select {
+	case <-ctx.Done():
+		g.locker.Lock()
+		defer g.locker.Unlock()
+		if g.rewound == rewound {
+			g.waiting--
+		}
+		return ctx.Err()
+	case <-rewound:
+		return nil
+	}
+}
+
+// Leave removes a source and its clocks once it stops looping, so the
+// others no longer wait for it.
+func (g *mediaClockGroup) Leave(clocks []*mediaClock) {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+	g.members--
+	for _, c := range clocks {
+		for i := range g.clocks {
+			if g.clocks[i] == c {
+				g.clocks = append(g.clocks[:i], g.clocks[i+1:]...)
+				break
+			}
+		}
+	}
+	g.rewindIfAll()
+}
+
+// rewindIfAll aligns the clocks and releases the waiting sources once all
+// of them wait, the caller must hold g.locker.
+func (g *mediaClockGroup) rewindIfAll() {
+	if g.waiting == 0 || g.waiting < g.members {
+		return
+	}
+	alignMediaClocks(g.clocks)
+	g.waiting = 0
+	close(g.rewound)
+	g.rewound = make(chan struct{})
+}
+
+func (f *fileSource) VideoMimeTypes() []string {
+	return []string{webrtc.MimeTypeH264}
+}
+
+// Run plays both files in passes on clocks of the group, the next pass
+// starts once both files and the other sources of the group reached EOF so
+// the audio and video never drift apart by the difference of their lengths.
+func (f *fileSource) Run(ctx context.Context, s sampleWriter, group *mediaClockGroup) {
+	clocks := group.NewClocks(2)
+	defer group.Leave(clocks)
+	video, audio := clocks[0], clocks[1]
+	for {
+		var wg sync.WaitGroup
+		var videoErr error
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			videoErr = f.playVideo(ctx, s, video)
+		}()
+		// a rendition may be a video file alone
+		audioErr := io.EOF
+		if f.audioFileName != "" {
+			audioErr = f.playAudio(ctx, s, audio)
+		}
+		wg.Wait()
+		for _, err := range []error{videoErr, audioErr} {
+			if err != io.EOF && err != context.Canceled {
+				log.Println(err)
+			}
+		}
+		if videoErr != io.EOF || audioErr != io.EOF || !f.loop {
+			return
+		}
+		if group.Rewind(ctx) != nil {
+			return
+		}
+		log.Println("Rewind Stream:", s.Name())
+	}
+}
+
+// playVideo plays the file once, one sample per access unit lasting the
+// frame duration of the SPS or h264FrameDuration when the SPS has no timing
+// info. Access units before the first IDR are skipped so that every loop
+// restarts on a keyframe.
+func (f *fileSource) playVideo(ctx context.Context, s sampleWriter, clock *mediaClock) error {
+	file, err := os.Open(f.videoFileName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+	}()
+	h264, err := newH264AccessUnitReader(file)
+	if err != nil {
+		return err
+	}
+	waitIDR := true
+	for {
+		au, err := h264.NextAccessUnit()
+		if err != nil {
+			return err
+		}
+		if waitIDR && !au.idr {
+			continue
+		}
+		waitIDR = false
+		frameDuration := h264.FrameDuration()
+		if frameDuration == 0 {
+			frameDuration = f.h264FrameDuration
+		}
+		sample := media.Sample{Data: au.Data(), Duration: frameDuration}
+		clock.Skip(&sample)
+		s.WriteSample(webrtc.MimeTypeH264, sample)
+		if err := clock.Wait(ctx, frameDuration); err != nil {
+			return err
+		}
+	}
+}
+
+// playAudio plays the file once, one sample per Opus packet lasting the
+// duration of its TOC, or oggPageDuration when the TOC is invalid.
+func (f *fileSource) playAudio(ctx context.Context, s sampleWriter, clock *mediaClock) error {
+	file, err := os.Open(f.audioFileName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+	}()
+	ogg := newOggOpusReader(file)
+	for {
+		packet, err := ogg.NextPacket()
+		if err != nil {
+			return err
+		}
+		sampleDuration := f.oggPageDuration
+		if samples, err := opusPacketSamples(packet); err == nil {
+			sampleDuration = opusSamplesDuration(samples)
+		}
+		sample := media.Sample{Data: packet, Duration: sampleDuration}
+		clock.Skip(&sample)
+		s.WriteSample(webrtc.MimeTypeOpus, sample)
+		if err := clock.Wait(ctx, sampleDuration); err != nil {
+			return err
+		}
+	}
+}
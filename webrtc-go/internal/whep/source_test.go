@@ -0,0 +1,54 @@
+package whep
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMediaClockGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// a rendition of one track and a source of two, the third source leaves
+	// before its first pass ends
+	group := newMediaClockGroup()
+	group.Add(2)
+	rendition := group.NewClocks(1)
+	tracks := group.NewClocks(2)
+	group.Leave(group.NewClocks(1))
+	rendition[0].elapsed = 30 * time.Millisecond
+	tracks[0].elapsed = 10 * time.Millisecond
+	tracks[1].elapsed = 20 * time.Millisecond
+
+	rewound := make(chan error)
+	go func() {
+		rewound <- group.Rewind(ctx)
+	}()
+	select {
+	case <-rewound:
+		t.Fatal("rewound before the other source ended its pass")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if err := group.Rewind(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-rewound; err != nil {
+		t.Fatal(err)
+	}
+	clocks := append(rendition, tracks...)
+	for i, gap := range []time.Duration{0, 20 * time.Millisecond, 10 * time.Millisecond} {
+		if clocks[i].elapsed != 30*time.Millisecond || clocks[i].gap != gap {
+			t.Errorf("clock %d at %v gap %v, want 30ms gap %v", i, clocks[i].elapsed, clocks[i].gap, gap)
+		}
+	}
+
+	// the source that stops looping releases the one waiting for it
+	go func() {
+		rewound <- group.Rewind(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	group.Leave(tracks)
+	if err := <-rewound; err != nil {
+		t.Fatal(err)
+	}
+}
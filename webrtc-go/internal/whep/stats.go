@@ -0,0 +1,403 @@
+package whep
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// STATS_BITRATE_WINDOW is the window of the sent bitrate, a stream idle
+// for twice as long is reported at 0.
+const STATS_BITRATE_WINDOW = time.Second
+
+// STATS_PATH serves the totals of every WHEP session, GET on a session
+// resource serves its own stats.
+const STATS_PATH = "/stats"
+
+// rtpCounter is what was sent on one SSRC and what the receiver reported
+// about it.
+type rtpCounter struct {
+	payloadType uint8
+	packets     uint64
+	bytes       uint64
+	// packets with the marker bit, the last packet of a video frame
+	frames uint64
+
+	windowStart time.Time
+	windowBytes uint64
+	bitrate     float64
+
+	nacks        uint32
+	plis         uint32
+	firs         uint32
+	fractionLost float64
+	packetsLost  int32
+	rtt          time.Duration
+
+	// the middle 32 bits of the NTP time of the last sender report and when
+	// it was sent, the receiver reports echo them back for the RTT
+	lastSenderReport   uint32
+	lastSenderReportAt time.Time
+}
+
+// statsInterceptor counts the RTP and RTCP of a peer connection per SSRC.
+// It is the first interceptor of the registry, the closest to the network,
+// so it sees the RTX and FlexFEC packets and the sender reports generated
+// by the others.
+type statsInterceptor struct {
+	interceptor.NoOp
+	locker   sync.Mutex
+	counters map[uint32]*rtpCounter
+}
+
+type statsInterceptorFactory struct {
+	onNewInterceptor func(*statsInterceptor)
+}
+
+func (f *statsInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	i := &statsInterceptor{counters: make(map[uint32]*rtpCounter)}
+	if f.onNewInterceptor != nil {
+		f.onNewInterceptor(i)
+	}
+	return i, nil
+}
+
+// counter returns the counter of the ssrc, the caller must hold i.locker.
+func (i *statsInterceptor) counter(ssrc uint32) *rtpCounter {
+	c, ok := i.counters[ssrc]
+	if !ok {
+		c = &rtpCounter{}
+		i.counters[ssrc] = c
+	}
+	return c
+}
+
+func (i *statsInterceptor) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, attributes)
+		if err != nil {
+			return n, err
+		}
+		now := time.Now()
+		i.locker.Lock()
+		c := i.counter(header.SSRC)
+		c.payloadType = header.PayloadType
+		c.packets++
+		c.bytes += uint64(len(payload))
+		if header.Marker {
+			c.frames++
+		}
+		c.windowBytes += uint64(len(payload))
+		if elapsed := now.Sub(c.windowStart); elapsed >= STATS_BITRATE_WINDOW {
+			if !c.windowStart.IsZero() {
+				c.bitrate = float64(c.windowBytes*8) / elapsed.Seconds()
+			}
+			c.windowStart, c.windowBytes = now, 0
+		}
+		i.locker.Unlock()
+		return n, nil
+	})
+}
+
+func (i *statsInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		now := time.Now()
+		i.locker.Lock()
+		for _, pkt := range pkts {
+			if sr, ok := pkt.(*rtcp.SenderReport); ok {
+				c := i.counter(sr.SSRC)
+				c.lastSenderReport = uint32(sr.NTPTime >> 16)
+				c.lastSenderReportAt = now
+			}
+		}
+		i.locker.Unlock()
+		return writer.Write(pkts, attributes)
+	})
+}
+
+func (i *statsInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, a)
+		if err != nil {
+			return n, attributes, err
+		}
+		if attributes == nil {
+			attributes = make(interceptor.Attributes)
+		}
+		pkts, err := attributes.GetRTCPPackets(b[:n])
+		if err != nil {
+			return n, attributes, nil
+		}
+		now := time.Now()
+		i.locker.Lock()
+		for _, pkt := range pkts {
+			switch pkt := pkt.(type) {
+			case *rtcp.TransportLayerNack:
+				i.counter(pkt.MediaSSRC).nacks++
+			case *rtcp.PictureLossIndication:
+				i.counter(pkt.MediaSSRC).plis++
+			case *rtcp.FullIntraRequest:
+				i.counter(pkt.MediaSSRC).firs++
+			case *rtcp.ReceiverReport:
+				i.receptionReports(pkt.Reports, now)
+			case *rtcp.SenderReport:
+				i.receptionReports(pkt.Reports, now)
+			}
+		}
+		i.locker.Unlock()
+		return n, attributes, nil
+	})
+}
+
+// receptionReports keeps the loss and the RTT of the reports, the caller
+// must hold i.locker.
+func (i *statsInterceptor) receptionReports(reports []rtcp.ReceptionReport, now time.Time) {
+	for _, report := range reports {
+		c := i.counter(report.SSRC)
+		c.fractionLost = float64(report.FractionLost) / 256
+		c.packetsLost = int32(report.TotalLost)
+		if report.LastSenderReport != 0 && report.LastSenderReport == c.lastSenderReport {
+			delay := time.Duration(report.Delay) * time.Second / 65536
+			if rtt := now.Sub(c.lastSenderReportAt) - delay; rtt >= 0 {
+				c.rtt = rtt
+			}
+		}
+	}
+}
+
+// snapshot copies the counters, the bitrate of a stream idle for two
+// windows drops to 0.
+func (i *statsInterceptor) snapshot() map[uint32]rtpCounter {
+	now := time.Now()
+	i.locker.Lock()
+	defer i.locker.Unlock()
+	counters := make(map[uint32]rtpCounter, len(i.counters))
+	for ssrc, c := range i.counters {
+		counter := *c
+		if now.Sub(c.windowStart) > 2*STATS_BITRATE_WINDOW {
+			counter.bitrate = 0
+		}
+		counters[ssrc] = counter
+	}
+	return counters
+}
+
+// trackStats are the stats of one sent track, named after the W3C
+// webrtc-stats outbound-rtp and remote-inbound-rtp members. The RTX and
+// FlexFEC packets are those of the repair SSRCs of the track.
+type trackStats struct {
+	Kind                     string  `json:"kind"`
+	MimeType                 string  `json:"mimeType"`
+	SSRC                     uint32  `json:"ssrc"`
+	PacketsSent              uint64  `json:"packetsSent"`
+	BytesSent                uint64  `json:"bytesSent"`
+	FramesSent               uint64  `json:"framesSent,omitempty"`
+	Bitrate                  float64 `json:"bitrate"`
+	NACKCount                uint32  `json:"nackCount"`
+	PLICount                 uint32  `json:"pliCount"`
+	FIRCount                 uint32  `json:"firCount"`
+	RetransmittedPacketsSent uint64  `json:"retransmittedPacketsSent"`
+	RetransmittedBytesSent   uint64  `json:"retransmittedBytesSent"`
+	FECPacketsSent           uint64  `json:"fecPacketsSent"`
+	FECBytesSent             uint64  `json:"fecBytesSent"`
+	FractionLost             float64 `json:"fractionLost"`
+	PacketsLost              int32   `json:"packetsLost"`
+	// seconds, as in webrtc-stats
+	RoundTripTime float64 `json:"roundTripTime"`
+}
+
+// sessionStats is the body of GET on a WHEP session resource.
+type sessionStats struct {
+	Resource        string `json:"resource"`
+	Stream          string `json:"stream"`
+	Profile         string `json:"profile"`
+	Rendition       string `json:"rendition"`
+	State           string `json:"state"`
+	ConnectionState string `json:"connectionState"`
+	// udp or tcp, and the type of the local candidate, of the selected
+	// candidate pair
+	Protocol      string `json:"protocol,omitempty"`
+	CandidateType string `json:"candidateType,omitempty"`
+	// the RTCP RTT of the video, or the STUN RTT of the candidate pair
+	RoundTripTime float64 `json:"roundTripTime"`
+	// the GCC target bitrate, 0 without GCC
+	EstimatedBitrate int          `json:"estimatedBitrate"`
+	Bitrate          float64      `json:"bitrate"`
+	Tracks           []trackStats `json:"tracks"`
+}
+
+// Stats builds the stats of the session from pc.GetStats, for the RTT of
+// the nominated candidate pair, and the counters of its statsInterceptor.
+// pion v3 GetStats has no outbound-rtp nor remote-inbound-rtp entries, and
+// the stats interceptor of pion/interceptor only counts the media SSRC it is
+// bound to, so the RTX and FlexFEC packets would be missed.
+func (c *whepClient) Stats(resource string) *sessionStats {
+	rendition, _ := c.Rendition()
+	stats := &sessionStats{
+		Resource:        resource,
+		Stream:          c.stream.name,
+		Profile:         c.profile,
+		Rendition:       rendition,
+		State:           c.State().String(),
+		ConnectionState: c.pc.ConnectionState().String(),
+		Tracks:          []trackStats{},
+	}
+	for _, s := range c.pc.GetStats() {
+		if pair, ok := s.(webrtc.ICECandidatePairStats); ok && pair.Nominated {
+			stats.RoundTripTime = pair.CurrentRoundTripTime
+		}
+	}
+	pair, err := c.pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err == nil && pair != nil {
+		stats.Protocol = pair.Local.Protocol.String()
+		stats.CandidateType = pair.Local.Typ.String()
+	}
+	if c.estimator != nil {
+		stats.EstimatedBitrate = c.estimator.GetTargetBitrate()
+	}
+	if c.stats == nil {
+		return stats
+	}
+	counters := c.stats.snapshot()
+	for _, sender := range c.pc.GetSenders() {
+		track := sender.Track()
+		params := sender.GetParameters()
+		if track == nil || len(params.Encodings) == 0 {
+			continue
+		}
+		t := trackStats{
+			Kind: track.Kind().String(),
+			SSRC: uint32(params.Encodings[0].SSRC),
+		}
+		if codec, ok := track.(sampleTrack); ok {
+			t.MimeType = codec.Codec().MimeType
+		}
+		mimeTypes := make(map[uint8]string)
+		for _, codec := range params.Codecs {
+			mimeTypes[uint8(codec.PayloadType)] = strings.ToLower(codec.MimeType)
+		}
+		for ssrc, counter := range counters {
+			switch mimeType := mimeTypes[counter.payloadType]; {
+			case ssrc == t.SSRC:
+				t.PacketsSent = counter.packets
+				t.BytesSent = counter.bytes
+				if track.Kind() == webrtc.RTPCodecTypeVideo {
+					t.FramesSent = counter.frames
+				}
+				t.NACKCount = counter.nacks
+				t.PLICount = counter.plis
+				t.FIRCount = counter.firs
+				t.FractionLost = counter.fractionLost
+				t.PacketsLost = counter.packetsLost
+				t.RoundTripTime = counter.rtt.Seconds()
+			case strings.HasSuffix(mimeType, "/rtx"):
+				t.RetransmittedPacketsSent += counter.packets
+				t.RetransmittedBytesSent += counter.bytes
+			case strings.Contains(mimeType, "fec"):
+				t.FECPacketsSent += counter.packets
+				t.FECBytesSent += counter.bytes
+			default:
+				continue
+			}
+			t.Bitrate += counter.bitrate
+		}
+		if t.RoundTripTime > 0 && (track.Kind() == webrtc.RTPCodecTypeVideo || stats.RoundTripTime == 0) {
+			stats.RoundTripTime = t.RoundTripTime
+		}
+		stats.Bitrate += t.Bitrate
+		stats.Tracks = append(stats.Tracks, t)
+	}
+	sort.Slice(stats.Tracks, func(i, j int) bool {
+		return stats.Tracks[i].Kind < stats.Tracks[j].Kind
+	})
+	return stats
+}
+
+// serverStats is the body of GET /stats, the totals of every WHEP session.
+type serverStats struct {
+	Sessions   int            `json:"sessions"`
+	Publishers int            `json:"publishers"`
+	Streams    int            `json:"streams"`
+	Profiles   map[string]int `json:"profiles"`
+	Protocols  map[string]int `json:"protocols"`
+
+	PacketsSent              uint64  `json:"packetsSent"`
+	BytesSent                uint64  `json:"bytesSent"`
+	FramesSent               uint64  `json:"framesSent"`
+	Bitrate                  float64 `json:"bitrate"`
+	NACKCount                uint32  `json:"nackCount"`
+	RetransmittedPacketsSent uint64  `json:"retransmittedPacketsSent"`
+	RetransmittedBytesSent   uint64  `json:"retransmittedBytesSent"`
+	FECPacketsSent           uint64  `json:"fecPacketsSent"`
+	FECBytesSent             uint64  `json:"fecBytesSent"`
+	// the mean of the sessions with an RTT
+	RoundTripTime float64 `json:"roundTripTime"`
+}
+
+func (h *whepHandler) sessionStats(resource string) (*sessionStats, error) {
+	h.locker.RLock()
+	c, ok := h.mapWhepClients[resource]
+	h.locker.RUnlock()
+	if !ok {
+		return nil, errSessionNotExist
+	}
+	return c.Stats(resource), nil
+}
+
+func (h *whepHandler) serverStats() *serverStats {
+	h.locker.RLock()
+	clients := make(map[string]*whepClient, len(h.mapWhepClients))
+	for resource, c := range h.mapWhepClients {
+		clients[resource] = c
+	}
+	stats := &serverStats{
+		Sessions:   len(h.mapWhepClients),
+		Publishers: len(h.mapWhipClients),
+		Streams:    len(h.mapStreams),
+		Profiles:   make(map[string]int),
+		Protocols:  make(map[string]int),
+	}
+	h.locker.RUnlock()
+	rtts := 0
+	for resource, c := range clients {
+		session := c.Stats(resource)
+		stats.Profiles[session.Profile]++
+		if session.Protocol != "" {
+			stats.Protocols[session.Protocol]++
+		}
+		stats.Bitrate += session.Bitrate
+		if session.RoundTripTime > 0 {
+			stats.RoundTripTime += session.RoundTripTime
+			rtts++
+		}
+		for _, t := range session.Tracks {
+			stats.PacketsSent += t.PacketsSent
+			stats.BytesSent += t.BytesSent
+			stats.FramesSent += t.FramesSent
+			stats.NACKCount += t.NACKCount
+			stats.RetransmittedPacketsSent += t.RetransmittedPacketsSent
+			stats.RetransmittedBytesSent += t.RetransmittedBytesSent
+			stats.FECPacketsSent += t.FECPacketsSent
+			stats.FECBytesSent += t.FECBytesSent
+		}
+	}
+	if rtts > 0 {
+		stats.RoundTripTime /= float64(rtts)
+	}
+	return stats
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
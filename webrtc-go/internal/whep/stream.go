@@ -0,0 +1,491 @@
+package whep
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// streamSource produces the samples of a stream until ctx is done, Run
+// returns once every goroutine it started has exited. A looping source takes
+// its clocks from the group and rewinds with it, so the sources of a stream
+// wrap together. VideoMimeTypes lists the video renditions it writes.
+type streamSource interface {
+	Run(ctx context.Context, s sampleWriter, group *mediaClockGroup)
+	VideoMimeTypes() []string
+}
+
+// sampleWriter receives the samples of a source, the stream itself or one
+// of its bitrate renditions.
+type sampleWriter interface {
+	Name() string
+	WriteSample(mimeType string, sample media.Sample)
+}
+
+// streamSources runs several sources together, such as the disk files and
+// the IVF renditions of the same video in other codecs.
+type streamSources []streamSource
+
+// Run counts the sources in the group in place of itself and plays them
+// together.
+func (sources streamSources) Run(ctx context.Context, s sampleWriter, group *mediaClockGroup) {
+	group.Add(len(sources) - 1)
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		wg.Add(1)
+		go func(source streamSource) {
+			defer wg.Done()
+			source.Run(ctx, s, group)
+		}(source)
+	}
+	wg.Wait()
+}
+
+func (sources streamSources) VideoMimeTypes() []string {
+	var mimeTypes []string
+	for _, source := range sources {
+		mimeTypes = append(mimeTypes, source.VideoMimeTypes()...)
+	}
+	return mimeTypes
+}
+
+// stream is the media of one path. A single source, the disk files and their
+// renditions or a WHIP publisher, is read once and its samples are fanned out to the tracks of
+// every connected WHEP subscriber, so all viewers share the same live point.
+type stream struct {
+	name   string
+	source streamSource
+	// the bitrate renditions of the video in ascending bitrate, none when
+	// the stream has a single one
+	renditions []rendition
+	gopCache   gopCacheConfig
+	// counts the goroutines writing to the subscribers: the source, the GOP
+	// bursts and the WHIP publisher, the streams of a handler share it
+	senders *sync.WaitGroup
+	// the sessions of the stream negotiated outside h.locker, the stream is
+	// not dropped before they are added or given up, guarded by h.locker
+	joining int
+
+	locker       sync.RWMutex
+	subscribers  map[*whepClient]bool
+	publisher    *whipClient
+	sourceCancel context.CancelFunc
+
+	gopLocker sync.Mutex
+	gops      map[videoKey]*gopCache
+}
+
+// whepClient is a WHEP subscriber, it owns the local tracks that the stream
+// writes to so that every viewer has its own RTP sequence and timestamps.
+// The video track only receives the rendition of its codec, and of its
+// bitrate once the stream has several.
+type whepClient struct {
+	*lifecycle
+	trickle    *iceTrickle
+	pc         *webrtc.PeerConnection
+	stream     *stream
+	videoTrack sampleTrack
+	audioTrack sampleTrack
+	profile    string
+	abr        *abrController
+	estimator  cc.BandwidthEstimator
+	stats      *statsInterceptor
+	clientIP   string
+
+	// the rendition asked with ?rendition= or ?layer=, kept across
+	// publishers
+	pinnedRendition string
+
+	renditionLocker  sync.Mutex
+	rendition        string
+	pendingRendition string
+	// the video is paused until the next keyframe
+	waitKeyframe      bool
+	keyframeRequested time.Time
+	burst             *gopBurst
+}
+
+// sampleTrack is a local track fed with samples, either pion's
+// TrackLocalStaticSample or h265TrackLocalStaticSample.
+type sampleTrack interface {
+	webrtc.TrackLocal
+	Codec() webrtc.RTPCodecCapability
+	WriteSample(sample media.Sample) error
+}
+
+func newStream(name string, source streamSource) *stream {
+	return &stream{
+		name:        name,
+		source:      source,
+		subscribers: make(map[*whepClient]bool),
+		gops:        make(map[videoKey]*gopCache),
+		senders:     &sync.WaitGroup{},
+	}
+}
+
+func newWhepClient(pc *webrtc.PeerConnection, s *stream, videoMimeType, pinnedRendition string) (*whepClient, error) {
+	c := &whepClient{
+		lifecycle:       newLifecycle(),
+		trickle:         &iceTrickle{},
+		pc:              pc,
+		stream:          s,
+		pinnedRendition: pinnedRendition,
+	}
+	s.locker.RLock()
+	c.rendition = s.subscriberRendition(c)
+	s.locker.RUnlock()
+	var err error
+	if strings.EqualFold(videoMimeType, webrtc.MimeTypeH265) {
+		c.videoTrack, err = newH265TrackLocalStaticSample("video", "pion")
+	} else {
+		c.videoTrack, err = webrtc.NewTrackLocalStaticSample(
+			webrtc.RTPCodecCapability{MimeType: videoMimeType}, "video", "pion")
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.audioTrack, err = webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+	if err != nil {
+		return nil, err
+	}
+	for _, track := range []webrtc.TrackLocal{c.videoTrack, c.audioTrack} {
+		rtpSender, err := pc.AddTrack(track)
+		if err != nil {
+			return nil, err
+		}
+		go c.readRTCP(rtpSender)
+	}
+	return c, nil
+}
+
+func (c *whepClient) readRTCP(rtpSender *webrtc.RTPSender) {
+	for {
+		pkts, _, err := rtpSender.ReadRTCP()
+		if err != nil || c.ctx.Err() != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				c.stream.RefreshVideo(c)
+			}
+		}
+	}
+}
+
+// track returns the local track of the codec, nil when the subscriber
+// negotiated another rendition.
+func (c *whepClient) track(mimeType string) sampleTrack {
+	for _, track := range []sampleTrack{c.videoTrack, c.audioTrack} {
+		if strings.EqualFold(track.Codec().MimeType, mimeType) {
+			return track
+		}
+	}
+	return nil
+}
+
+func (s *stream) Name() string {
+	return s.name
+}
+
+// VideoMimeTypes lists the video codecs a subscriber may negotiate, the
+// codec of the WHIP publisher while there is one, else the renditions of
+// the disk source.
+func (s *stream) VideoMimeTypes() []string {
+	if publisher := s.Publisher(); publisher != nil {
+		if mimeTypes := publisher.VideoMimeTypes(); len(mimeTypes) > 0 {
+			return mimeTypes
+		}
+	}
+	if s.source == nil {
+		return nil
+	}
+	return s.source.VideoMimeTypes()
+}
+
+// Attach registers a subscriber, it receives no samples until Activate.
+func (s *stream) Attach(c *whepClient) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.subscribers[c] = false
+}
+
+// Activate starts fanning out samples to the subscriber once its peer
+// connection is connected, from the cached GOP or the next keyframe. The first active
+// subscriber starts the file source.
+func (s *stream) Activate(c *whepClient) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if _, ok := s.subscribers[c]; !ok {
+		return
+	}
+	s.subscribers[c] = true
+	s.startVideo(c)
+	if s.publisher == nil {
+		s.startSource()
+	}
+}
+
+func (s *stream) Detach(c *whepClient) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	c.stopBurst()
+	delete(s.subscribers, c)
+	if len(s.subscribers) == 0 {
+		s.stopSource()
+	}
+}
+
+// Idle reports whether the stream can be dropped by the handler.
+func (s *stream) Idle() bool {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	return len(s.subscribers) == 0 && s.publisher == nil
+}
+
+// SetPublisher makes a WHIP publisher the source of the stream, subscribers
+// already watching the disk files switch over to the live tracks, or to
+// their layer of a simulcast publisher.
+func (s *stream) SetPublisher(c *whipClient) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.stopSource()
+	s.clearGOPs()
+	s.publisher = c
+	s.restartSubscribers()
+}
+
+func (s *stream) UnsetPublisher(c *whipClient) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.publisher != c {
+		return
+	}
+	s.publisher = nil
+	s.clearGOPs()
+	s.restartSubscribers()
+	for _, active := range s.subscribers {
+		if active {
+			s.startSource()
+			break
+		}
+	}
+}
+
+// restartSubscribers moves the subscribers to their rendition of the new
+// source, where they wait for its first keyframe, the caller must hold
+// s.locker.
+func (s *stream) restartSubscribers() {
+	for subscriber := range s.subscribers {
+		subscriber.stopBurst()
+		subscriber.switchRendition(s.subscriberRendition(subscriber))
+		if hasKeyframes(subscriber.videoTrack.Codec().MimeType) {
+			subscriber.setWaitKeyframe(true)
+		}
+	}
+}
+
+func (s *stream) Publisher() *whipClient {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	return s.publisher
+}
+
+// RequestRenditionKeyframe asks the publisher for a keyframe of the
+// rendition, the disk files have no way to produce one.
+func (s *stream) RequestRenditionKeyframe(rendition string) {
+	s.locker.RLock()
+	publisher := s.publisher
+	s.locker.RUnlock()
+	if publisher != nil {
+		publisher.RequestLayerKeyframe(rendition)
+	}
+}
+
+// WriteSample writes the sample to the track of the codec of every active
+// subscriber.
+func (s *stream) WriteSample(mimeType string, sample media.Sample) {
+	s.writeRenditionSample(MAIN_RENDITION, mimeType, sample)
+}
+
+func (s *stream) writeRenditionSample(rendition, mimeType string, sample media.Sample) {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	keyframe := false
+	if strings.HasPrefix(strings.ToLower(mimeType), "video/") {
+		keyframe = isKeyframe(mimeType, sample.Data)
+		sample = s.cacheVideo(newVideoKey(rendition, mimeType), sample, keyframe)
+	}
+	for c, active := range s.subscribers {
+		if !active {
+			continue
+		}
+		track := c.track(mimeType)
+		if track == nil {
+			continue
+		}
+		if track == c.videoTrack && (!c.takesVideo(rendition, keyframe) || c.queueBurst(sample)) {
+			continue
+		}
+		if err := track.WriteSample(sample); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (s *stream) startSource() {
+	if s.sourceCancel != nil || s.source == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.sourceCancel = cancel
+	s.senders.Add(1)
+	go func() {
+		defer s.senders.Done()
+		s.source.Run(ctx, s, newMediaClockGroup())
+	}()
+	log.Println("Start Stream Source:", s.name)
+}
+
+func (s *stream) stopSource() {
+	if s.sourceCancel == nil {
+		return
+	}
+	s.sourceCancel()
+	s.sourceCancel = nil
+	log.Println("Stop Stream Source:", s.name)
+}
+
+// newStream creates a stream played from the disk files of its path until a
+// WHIP publisher takes it over, the caller must hold h.locker.
+func (h *whepHandler) newStream(name string) *stream {
+	s := newStream(name, nil)
+	source := h.sourceConfig(name)
+	sources := streamSources{newFileSource(source)}
+	if source.H265File != "" {
+		sources = append(sources, &h265Source{
+			fileName:      source.H265File,
+			frameDuration: source.H264FrameDuration,
+			loop:          *source.Loop,
+		})
+	}
+	for _, ivf := range source.ivfSources {
+		sources = append(sources, ivf)
+	}
+	for _, rendition := range source.Renditions {
+		sources = append(sources, &renditionSource{
+			writer: &renditionWriter{stream: s, rendition: rendition.Name},
+			source: newFileSource(rendition.sourceConfig(source)),
+		})
+	}
+	s.source = sources
+	s.renditions = source.renditions()
+	s.gopCache = h.gopCache
+	s.senders = &h.senders
+	return s
+}
+
+func newFileSource(source *sourceConfig) streamSource {
+	switch strings.ToLower(path.Ext(source.MediaFile)) {
+	case ".mp4":
+		return &mp4Source{fileName: source.MediaFile, loop: *source.Loop}
+	case ".mkv", ".webm":
+		return newMKVSource(source.MediaFile, *source.Loop)
+	}
+	return &fileSource{
+		videoFileName:     source.VideoFile,
+		audioFileName:     source.AudioFile,
+		oggPageDuration:   source.OggPageDuration,
+		h264FrameDuration: source.H264FrameDuration,
+		loop:              *source.Loop,
+	}
+}
+
+// sourceConfig returns the path entry of the stream, or the default source.
+func (h *whepHandler) sourceConfig(name string) *sourceConfig {
+	if source, ok := h.paths[name]; ok {
+		return source
+	}
+	return h.source
+}
+
+// openSources checks the files of every source and opens their IVF
+// renditions, so a missing file fails at startup instead of on the first
+// subscriber of its path.
+func (h *whepHandler) openSources() error {
+	sources := []*sourceConfig{h.source}
+	for _, source := range h.paths {
+		sources = append(sources, source)
+	}
+	for _, source := range sources {
+		fileNames := []string{source.MediaFile}
+		if source.MediaFile == "" {
+			fileNames = []string{source.AudioFile, source.VideoFile}
+		}
+		if source.H265File != "" {
+			fileNames = append(fileNames, source.H265File)
+		}
+		for _, rendition := range source.Renditions {
+			fileNames = append(fileNames, rendition.MediaFile+rendition.VideoFile)
+		}
+		for _, fileName := range fileNames {
+			if _, err := os.Stat(fileName); err != nil {
+				return err
+			}
+			if strings.ToLower(path.Ext(fileName)) == ".mp4" {
+				if _, err := readMP4Tracks(fileName); err != nil {
+					return fmt.Errorf("%w: %s", err, fileName)
+				}
+			}
+		}
+		source.ivfSources = nil
+		for _, fileName := range source.IVFFiles {
+			ivf, err := newIVFSource(fileName, *source.Loop)
+			if err != nil {
+				return err
+			}
+			source.ivfSources = append(source.ivfSources, ivf)
+		}
+	}
+	return nil
+}
+
+// joinStream returns the stream of name, created if needed, counted as
+// joining until leaveStream.
+func (h *whepHandler) joinStream(name string) *stream {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	s, ok := h.mapStreams[name]
+	if !ok {
+		s = h.newStream(name)
+		h.mapStreams[name] = s
+	}
+	s.joining++
+	return s
+}
+
+// leaveStream ends the joining of a session once it is added or given up,
+// it is called with h.locker held.
+func (h *whepHandler) leaveStream(s *stream) {
+	s.joining--
+	h.releaseStream(s)
+}
+
+// releaseStream drops the stream once it has neither subscribers nor a
+// publisher, the caller must hold h.locker.
+func (h *whepHandler) releaseStream(s *stream) {
+	if s.joining == 0 && s.Idle() && h.mapStreams[s.name] == s {
+		delete(h.mapStreams, s.name)
+	}
+}
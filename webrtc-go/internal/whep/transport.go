@@ -0,0 +1,222 @@
+package whep
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/flexfec"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/pacer"
+	"github.com/pion/interceptor/pkg/playoutdelay"
+	"github.com/pion/interceptor/pkg/red"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	SDES_MID_URI                    = "urn:ietf:params:rtp-hdrext:sdes:mid"
+	SDES_RTP_STREAM_ID_URI          = "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"
+	SDES_REPAIRED_RTP_STREAM_ID_URI = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+	// the pion default, the ICE timeouts are set together
+	ICE_KEEPALIVE_INTERVAL = time.Second * 2
+)
+
+type TransportParams struct {
+	Configuration     webrtc.Configuration
+	ICEUDPMux         ice.UDPMux
+	ICETCPMux         ice.TCPMux
+	ICELite           bool
+	ICEProtocolPolicy webrtc.ICEProtocolPolicy
+	// how long without traffic from the peer before ICE is disconnected,
+	// and then failed, which closes the session
+	ICEDisconnectedTimeout time.Duration
+	ICEFailedTimeout       time.Duration
+	NAT1To1IPs             []string
+	EnabledAudioCodecs     []webrtc.RTPCodecParameters
+	EnabledVideoCodecs     []webrtc.RTPCodecParameters
+	Profile                profile
+	IsSendSide             bool
+	NACKGeneratorSize      uint16
+	NACKGeneratorInterval  time.Duration
+	NACKResponderSize      uint16
+	PlayoutDelayMin        time.Duration
+	PlayoutDelayMax        time.Duration
+	GCCInitialBitrate      int
+	// receives the GCC estimator of the peer connection
+	OnBandwidthEstimator func(estimator cc.BandwidthEstimator)
+	// receives the RTP/RTCP counters of the peer connection
+	OnStatsInterceptor func(stats *statsInterceptor)
+}
+
+func createPeerConnection(params *TransportParams) (pc *webrtc.PeerConnection, err error) {
+	// SettingsEngine
+	settingsEngine := webrtc.SettingEngine{}
+	networkTypes := []webrtc.NetworkType{}
+	if len(params.NAT1To1IPs) > 0 {
+		settingsEngine.SetNAT1To1IPs(params.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+	if params.ICEUDPMux != nil {
+		settingsEngine.SetICEUDPMux(params.ICEUDPMux)
+		networkTypes = append(networkTypes, webrtc.NetworkTypeUDP4)
+	}
+	if params.ICETCPMux != nil {
+		settingsEngine.SetICETCPMux(params.ICETCPMux)
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4)
+	}
+	if len(networkTypes) > 0 {
+		settingsEngine.SetNetworkTypes(networkTypes)
+	}
+	settingsEngine.SetLite(params.ICELite)
+	settingsEngine.SetICEProtocolPolicy(params.ICEProtocolPolicy)
+	if params.ICEDisconnectedTimeout > 0 && params.ICEFailedTimeout > 0 {
+		settingsEngine.SetICETimeouts(params.ICEDisconnectedTimeout, params.ICEFailedTimeout, ICE_KEEPALIVE_INTERVAL)
+	}
+	// FlexFEC and RED only pay off over UDP
+	features := params.Profile
+	if params.ICEProtocolPolicy == webrtc.ICEProtocolPolicyPreferTCP {
+		features.FlexFEC = false
+		features.RED = false
+	}
+	settingsEngine.SetTrackLocalRtx(features.RTX)
+	settingsEngine.SetTrackLocalFlexfec(features.FlexFEC)
+	// MediaEngine
+	mediaEngine := &webrtc.MediaEngine{}
+	for _, codec := range params.EnabledAudioCodecs {
+		if !features.RED && strings.EqualFold(codec.MimeType, webrtc.MimeTypeRed) {
+			continue
+		}
+		if err := mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, err
+		}
+	}
+	for _, codec := range params.EnabledVideoCodecs {
+		if !features.RTX && strings.EqualFold(codec.MimeType, "video/rtx") {
+			continue
+		}
+		if !features.FlexFEC && strings.EqualFold(codec.MimeType, "video/flexfec-03") {
+			continue
+		}
+		if err := mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+	// Simulcast, the layers of a WHIP publisher are told apart by the mid and
+	// rid header extensions of their first packets
+	if !params.IsSendSide {
+		for _, uri := range []string{SDES_MID_URI, SDES_RTP_STREAM_ID_URI, SDES_REPAIRED_RTP_STREAM_ID_URI} {
+			if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// InterceptorRegistry
+	interceptorRegistry := &interceptor.Registry{}
+	// Configure Stats, first so that it counts the packets the others add
+	interceptorRegistry.Add(&statsInterceptorFactory{onNewInterceptor: params.OnStatsInterceptor})
+	// Configure Pacer
+	if features.Pacer && params.IsSendSide {
+		pacer, err := pacer.NewInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		interceptorRegistry.Add(pacer)
+	}
+	// Configure FlexFEC
+	if features.FlexFEC && params.IsSendSide {
+		flexFec, err := flexfec.NewFecInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		interceptorRegistry.Add(flexFec)
+	}
+	// Configure RED
+	if features.RED && params.IsSendSide {
+		red, err := red.NewInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		interceptorRegistry.Add(red)
+	}
+	// Configure PlayoutDelay
+	if features.PlayoutDelay && params.IsSendSide {
+		if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: playoutdelay.PlayoutDelayURI}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+		playoutDelay, err := playoutdelay.NewInterceptor(
+			playoutdelay.PlayoutDelayMin(params.PlayoutDelayMin),
+			playoutdelay.PlayoutDelayMax(params.PlayoutDelayMax),
+		)
+		if err != nil {
+			return nil, err
+		}
+		interceptorRegistry.Add(playoutDelay)
+	}
+	// Configure Nack
+	if features.NACK {
+		mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+		mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+		if params.IsSendSide {
+			responder, err := nack.NewResponderInterceptor(
+				nack.ResponderSize(params.NACKResponderSize),
+			)
+			if err != nil {
+				return nil, err
+			}
+			interceptorRegistry.Add(responder)
+		} else {
+			generator, err := nack.NewGeneratorInterceptor(
+				nack.GeneratorSize(params.NACKGeneratorSize),
+				nack.GeneratorSkipLastN(0),
+				nack.GeneratorMaxNacksPerPacket(0),
+				nack.GeneratorInterval(params.NACKGeneratorInterval),
+			)
+			if err != nil {
+				return nil, err
+			}
+			interceptorRegistry.Add(generator)
+		}
+	} else {
+		// PLI is still needed to recover from a loss without NACK
+		mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	}
+	// Configure RTCP Reports
+	if err := webrtc.ConfigureRTCPReports(interceptorRegistry); err != nil {
+		return nil, err
+	}
+	// Configure TWCC Sender
+	if features.TWCC && params.IsSendSide {
+		if err := webrtc.ConfigureTWCCSender(mediaEngine, interceptorRegistry); err != nil {
+			return nil, err
+		}
+	}
+	// Configure GCC, the transport-wide sequence numbers of the outgoing
+	// packets are matched with the TWCC feedback of the receiver
+	if features.GCC && params.IsSendSide {
+		ccInterceptor, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+			return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(params.GCCInitialBitrate))
+		})
+		if err != nil {
+			return nil, err
+		}
+		if params.OnBandwidthEstimator != nil {
+			ccInterceptor.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+				params.OnBandwidthEstimator(estimator)
+			})
+		}
+		interceptorRegistry.Add(ccInterceptor)
+		headerExtension, err := twcc.NewHeaderExtensionInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		interceptorRegistry.Add(headerExtension)
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithSettingEngine(settingsEngine),
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(interceptorRegistry)).NewPeerConnection(params.Configuration)
+}
@@ -0,0 +1,284 @@
+package whep
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const SDP_FRAG_CONTENT_TYPE = "application/trickle-ice-sdpfrag"
+
+var errETagMismatch = errors.New("etag mismatch")
+
+// iceTrickle is the trickle ICE state of a session. A session is answered
+// without waiting for the gathering of its local candidates, the ones
+// gathered after the answer are returned by its next PATCH request.
+type iceTrickle struct {
+	// held through a PATCH so that its If-Match check and the ICE restart
+	// it guards are not interleaved with another PATCH
+	patchLocker sync.Mutex
+
+	locker     sync.Mutex
+	candidates []string
+	gathered   bool
+}
+
+// onCandidate is the OnICECandidate handler of the session, a nil
+// candidate ends the gathering.
+func (t *iceTrickle) onCandidate(candidate *webrtc.ICECandidate) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if candidate == nil {
+		t.gathered = true
+		return
+	}
+	t.candidates = append(t.candidates, candidate.ToJSON().Candidate)
+}
+
+// reset drops the candidates of the local description about to be sent, it
+// is called right after SetLocalDescription.
+func (t *iceTrickle) reset() {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.candidates = nil
+	t.gathered = false
+}
+
+// take returns the candidates not sent yet and whether the gathering ended
+// since the last call.
+func (t *iceTrickle) take() ([]string, bool) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	candidates, gathered := t.candidates, t.gathered
+	t.candidates = nil
+	t.gathered = false
+	return candidates, gathered
+}
+
+// sdpFragment is the body of a trickle ICE or ICE restart PATCH request,
+// see RFC 8840 and the WHIP/WHEP session PATCH procedures.
+type sdpFragment struct {
+	iceUfrag        string
+	icePwd          string
+	candidates      []webrtc.ICECandidateInit
+	endOfCandidates bool
+}
+
+func parseSDPFragment(body string) (*sdpFragment, error) {
+	frag := &sdpFragment{}
+	var mid *string
+	var mLineIndex uint16
+	mLineCount := 0
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "m="):
+			mid = nil
+			mLineIndex = uint16(mLineCount)
+			mLineCount++
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			frag.iceUfrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			frag.icePwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			}
+			if mLineCount > 0 {
+				index := mLineIndex
+				candidate.SDPMLineIndex = &index
+			}
+			frag.candidates = append(frag.candidates, candidate)
+		case line == "a=end-of-candidates":
+			frag.endOfCandidates = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if (frag.iceUfrag == "") != (frag.icePwd == "") {
+		return nil, errors.New("sdpfrag must carry both ice-ufrag and ice-pwd")
+	}
+	return frag, nil
+}
+
+// marshalSDPFragment answers a PATCH with the local credentials of the
+// bundled media section and the candidates gathered since the last answer,
+// the answer of an ICE restart also carries the candidates of desc.
+func marshalSDPFragment(desc *webrtc.SessionDescription, restart bool, candidates []string, endOfCandidates bool) (string, error) {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return "", err
+	}
+	if len(parsed.MediaDescriptions) == 0 {
+		return "", errors.New("local description has no media")
+	}
+	media := parsed.MediaDescriptions[0]
+	var b strings.Builder
+	if _, ok := parsed.Attribute(sdp.AttrKeyICELite); ok {
+		b.WriteString("a=ice-lite\r\n")
+	}
+	for _, key := range []string{"ice-ufrag", "ice-pwd"} {
+		value, ok := media.Attribute(key)
+		if !ok {
+			value, _ = parsed.Attribute(key)
+		}
+		b.WriteString("a=" + key + ":" + value + "\r\n")
+	}
+	b.WriteString("m=" + media.MediaName.String() + "\r\n")
+	for _, a := range media.Attributes {
+		switch a.Key {
+		case sdp.AttrKeyMID:
+			b.WriteString("a=" + a.String() + "\r\n")
+		case "candidate", "end-of-candidates":
+			if restart {
+				b.WriteString("a=" + a.String() + "\r\n")
+			}
+		}
+	}
+	for _, candidate := range candidates {
+		b.WriteString("a=" + candidate + "\r\n")
+	}
+	if endOfCandidates {
+		b.WriteString("a=end-of-candidates\r\n")
+	}
+	return b.String(), nil
+}
+
+// restartOffer rewrites the current remote offer with the ICE credentials of
+// the PATCH request, setting it on the PeerConnection restarts the ICE agent.
+func restartOffer(desc *webrtc.SessionDescription, iceUfrag, icePwd string) (string, error) {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return "", err
+	}
+	parsed.Attributes = replaceICECredentials(parsed.Attributes, iceUfrag, icePwd)
+	for _, media := range parsed.MediaDescriptions {
+		media.Attributes = replaceICECredentials(media.Attributes, iceUfrag, icePwd)
+	}
+	parsed.Origin.SessionVersion++
+	b, err := parsed.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func replaceICECredentials(attributes []sdp.Attribute, iceUfrag, icePwd string) []sdp.Attribute {
+	replaced := attributes[:0]
+	for _, a := range attributes {
+		switch a.Key {
+		case "ice-ufrag":
+			a.Value = iceUfrag
+		case "ice-pwd":
+			a.Value = icePwd
+		case "candidate", "end-of-candidates":
+			continue
+		}
+		replaced = append(replaced, a)
+	}
+	return replaced
+}
+
+func parseICEUfrag(sdpStr string) string {
+	for _, line := range strings.Split(sdpStr, "\n") {
+		if ufrag, ok := strings.CutPrefix(strings.TrimSpace(line), "a=ice-ufrag:"); ok {
+			return ufrag
+		}
+	}
+	return ""
+}
+
+// sessionETag identifies the ICE session of a description by its ufrag, so
+// it changes whenever the ICE agent is restarted.
+func sessionETag(sdpStr string) string {
+	return `"` + parseICEUfrag(sdpStr) + `"`
+}
+
+func (h *whepHandler) lookupSession(resource string) (*webrtc.PeerConnection, *iceTrickle, bool) {
+	h.locker.RLock()
+	defer h.locker.RUnlock()
+	if c, ok := h.mapWhepClients[resource]; ok {
+		return c.pc, c.trickle, true
+	}
+	if c, ok := h.mapWhipClients[resource]; ok {
+		return c.pc, c.trickle, true
+	}
+	return nil, nil, false
+}
+
+// patchClient adds the trickled remote candidates of a session, or restarts
+// its ICE agent when the fragment carries new credentials. The answer
+// fragment carries the local candidates gathered since the last answer,
+// and the new credentials of an ICE restart, it is empty when there is
+// nothing to send.
+func (h *whepHandler) patchClient(resource, ifMatch, fragStr string) (etag, answerFrag string, err error) {
+	pc, trickle, ok := h.lookupSession(resource)
+	if !ok {
+		return "", "", errSessionNotExist
+	}
+	trickle.patchLocker.Lock()
+	defer trickle.patchLocker.Unlock()
+	etag = sessionETag(pc.LocalDescription().SDP)
+	if ifMatch != "" && ifMatch != "*" && ifMatch != etag {
+		return "", "", errETagMismatch
+	}
+	frag, err := parseSDPFragment(fragStr)
+	if err != nil {
+		return "", "", wrapError(errBadRequest, err)
+	}
+	remote := pc.RemoteDescription()
+	restart := frag.iceUfrag != "" && frag.iceUfrag != parseICEUfrag(remote.SDP)
+	if restart {
+		offer, err := restartOffer(remote, frag.iceUfrag, frag.icePwd)
+		if err != nil {
+			return "", "", err
+		}
+		if err = pc.SetRemoteDescription(webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  offer,
+		}); err != nil {
+			return "", "", wrapError(errUnacceptableSDP, err)
+		}
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			return "", "", err
+		}
+		if err = pc.SetLocalDescription(answer); err != nil {
+			return "", "", err
+		}
+		trickle.reset()
+		etag = sessionETag(pc.LocalDescription().SDP)
+		log.Println("ICE restart:", resource)
+	}
+	for _, candidate := range frag.candidates {
+		if err = pc.AddICECandidate(candidate); err != nil {
+			return "", "", wrapError(errBadRequest, err)
+		}
+	}
+	if frag.endOfCandidates {
+		if err = pc.AddICECandidate(webrtc.ICECandidateInit{}); err != nil {
+			return "", "", err
+		}
+	}
+	candidates, gathered := trickle.take()
+	if !restart && len(candidates) == 0 && !gathered {
+		return etag, "", nil
+	}
+	answerFrag, err = marshalSDPFragment(pc.LocalDescription(), restart, candidates, gathered)
+	if err != nil {
+		return "", "", err
+	}
+	return etag, answerFrag, nil
+}
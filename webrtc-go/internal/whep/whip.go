@@ -0,0 +1,333 @@
+package whep
+
+import (
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+const (
+	WHIP_VIDEO_MAX_LATE = 256
+	WHIP_AUDIO_MAX_LATE = 16
+	// the bitrate of a simulcast layer is measured over this window
+	WHIP_LAYER_BITRATE_WINDOW = time.Second
+)
+
+// whipClient is a WHIP publisher, the samples of its remote tracks are the
+// source of the stream with the same name. A simulcast publisher has one
+// video track per layer, each layer is a rendition of the stream named by
+// its RID.
+type whipClient struct {
+	*lifecycle
+	trickle  *iceTrickle
+	pc       *webrtc.PeerConnection
+	stream   *stream
+	clientIP string
+	// the RIDs of the offer in the order of a=simulcast, none without
+	// simulcast
+	rids []string
+
+	locker       sync.RWMutex
+	remoteTracks map[webrtc.RTPCodecType]*webrtc.TrackRemote
+	layers       map[string]*whipLayer
+}
+
+// whipLayer is the remote track of a simulcast layer and its bitrate.
+type whipLayer struct {
+	track   *webrtc.TrackRemote
+	bitrate int
+}
+
+// streamName maps both "/live/livestream.whip" and "/live/livestream.whep"
+// to the stream "/live/livestream".
+func streamName(path string) string {
+	if i := strings.LastIndex(path, "."); i > strings.LastIndex(path, "/") {
+		return path[:i]
+	}
+	return path
+}
+
+func isWhipPath(path string) bool {
+	return strings.HasSuffix(path, ".whip")
+}
+
+// RequestKeyframe asks the publisher for a new IDR of every layer.
+func (c *whipClient) RequestKeyframe() {
+	c.locker.RLock()
+	var pkts []rtcp.Packet
+	if track, ok := c.remoteTracks[webrtc.RTPCodecTypeVideo]; ok {
+		pkts = append(pkts, &rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())})
+	}
+	for _, layer := range c.layers {
+		pkts = append(pkts, &rtcp.PictureLossIndication{MediaSSRC: uint32(layer.track.SSRC())})
+	}
+	c.locker.RUnlock()
+	if len(pkts) == 0 {
+		return
+	}
+	if err := c.pc.WriteRTCP(pkts); err != nil {
+		log.Println(err)
+	}
+}
+
+// RequestLayerKeyframe asks for a new IDR of the rendition only, it is
+// called when a subscriber joins, sends PLI/FIR or switches to the layer.
+func (c *whipClient) RequestLayerKeyframe(rid string) {
+	c.locker.RLock()
+	layer, ok := c.layers[rid]
+	c.locker.RUnlock()
+	if !ok {
+		c.RequestKeyframe()
+		return
+	}
+	if err := c.pc.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(layer.track.SSRC())},
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+// VideoMimeTypes is the codec of the video the publisher sends, until its
+// track arrives the first video codec of the offer that was negotiated,
+// browsers send their preferred one.
+func (c *whipClient) VideoMimeTypes() []string {
+	c.locker.RLock()
+	track := c.remoteTracks[webrtc.RTPCodecTypeVideo]
+	for _, layer := range c.layers {
+		if track == nil {
+			track = layer.track
+		}
+	}
+	c.locker.RUnlock()
+	if track != nil {
+		return []string{track.Codec().MimeType}
+	}
+	for _, transceiver := range c.pc.GetTransceivers() {
+		if transceiver.Kind() != webrtc.RTPCodecTypeVideo || transceiver.Receiver() == nil {
+			continue
+		}
+		for _, codec := range transceiver.Receiver().GetParameters().Codecs {
+			switch codec.MimeType {
+			case webrtc.MimeTypeH264, webrtc.MimeTypeVP8, webrtc.MimeTypeVP9:
+				return []string{codec.MimeType}
+			}
+		}
+	}
+	return nil
+}
+
+// DefaultLayer is the rendition of the subscribers that neither pinned a
+// layer nor have an estimator, the first RID of the offer.
+func (c *whipClient) DefaultLayer() string {
+	if len(c.rids) == 0 {
+		return ""
+	}
+	return c.rids[0]
+}
+
+// Layers lists the simulcast layers in ascending measured bitrate, the
+// layers not measured yet come first in the reverse order of the offer,
+// since browsers offer the highest layer first.
+func (c *whipClient) Layers() []rendition {
+	if len(c.rids) == 0 {
+		return nil
+	}
+	c.locker.RLock()
+	defer c.locker.RUnlock()
+	layers := make([]rendition, 0, len(c.rids))
+	for i := len(c.rids) - 1; i >= 0; i-- {
+		r := rendition{name: c.rids[i]}
+		if layer, ok := c.layers[r.name]; ok {
+			r.bitrate = layer.bitrate
+		}
+		layers = append(layers, r)
+	}
+	sort.SliceStable(layers, func(i, j int) bool {
+		return layers[i].bitrate < layers[j].bitrate
+	})
+	return layers
+}
+
+func (c *whipClient) forward(remoteTrack *webrtc.TrackRemote) {
+	var depacketizer rtp.Depacketizer
+	var maxLate uint16
+	switch remoteTrack.Codec().MimeType {
+	case webrtc.MimeTypeH264:
+		depacketizer, maxLate = &codecs.H264Packet{}, WHIP_VIDEO_MAX_LATE
+	case webrtc.MimeTypeVP8:
+		depacketizer, maxLate = &codecs.VP8Packet{}, WHIP_VIDEO_MAX_LATE
+	case webrtc.MimeTypeVP9:
+		depacketizer, maxLate = &codecs.VP9Packet{}, WHIP_VIDEO_MAX_LATE
+	case webrtc.MimeTypeOpus:
+		depacketizer, maxLate = &codecs.OpusPacket{}, WHIP_AUDIO_MAX_LATE
+	default:
+		log.Println("unsupported WHIP codec:", remoteTrack.Codec().MimeType)
+		return
+	}
+	rid := remoteTrack.RID()
+	rendition := MAIN_RENDITION
+	c.locker.Lock()
+	if rid != "" {
+		rendition = rid
+		c.layers[rid] = &whipLayer{track: remoteTrack}
+	} else {
+		c.remoteTracks[remoteTrack.Kind()] = remoteTrack
+	}
+	c.locker.Unlock()
+	if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+		c.RequestLayerKeyframe(rendition)
+	}
+	builder := samplebuilder.New(maxLate, depacketizer, remoteTrack.Codec().ClockRate)
+	bytes, since := 0, time.Now()
+	for {
+		pkt, _, err := remoteTrack.ReadRTP()
+		if err != nil || c.ctx.Err() != nil {
+			return
+		}
+		if rid != "" {
+			bytes += len(pkt.Payload)
+			if elapsed := time.Since(since); elapsed >= WHIP_LAYER_BITRATE_WINDOW {
+				c.locker.Lock()
+				c.layers[rid].bitrate = int(int64(bytes) * 8 * int64(time.Second) / int64(elapsed))
+				c.locker.Unlock()
+				bytes, since = 0, time.Now()
+			}
+		}
+		builder.Push(pkt)
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			c.stream.writeRenditionSample(rendition, remoteTrack.Codec().MimeType, *sample)
+		}
+	}
+}
+
+func (h *whepHandler) createWhipClient(url *url.URL, offerStr, clientIP string) (string, string, error) {
+	// a publisher is not counted against the subscribers of its stream,
+	// like a subscriber it is negotiated without h.locker
+	if err := h.admission.admit("", clientIP); err != nil {
+		return "", "", err
+	}
+	name := streamName(url.Path)
+	s := h.joinStream(name)
+	added := false
+	var pc *webrtc.PeerConnection
+	var c *whipClient
+	defer func() {
+		if added {
+			return
+		}
+		if c != nil {
+			c.closing()
+		}
+		if pc != nil {
+			pc.Close()
+		}
+		h.locker.Lock()
+		h.leaveStream(s)
+		h.locker.Unlock()
+		h.admission.leave("", clientIP)
+	}()
+	if s.Publisher() != nil {
+		return "", "", errStreamConflict
+	}
+	resource := newResourcePath(url.Path)
+	_, p, err := h.sessionProfile(url)
+	if err != nil {
+		return "", "", wrapError(errBadRequest, err)
+	}
+	rids, err := offeredSimulcastRIDs(offerStr)
+	if err != nil {
+		return "", "", wrapError(errUnacceptableSDP, err)
+	}
+	pc, _, _, err = h.newPeerConnection(url, p, false)
+	if err != nil {
+		return "", "", err
+	}
+	c = &whipClient{
+		lifecycle:    newLifecycle(),
+		trickle:      &iceTrickle{},
+		pc:           pc,
+		stream:       s,
+		clientIP:     clientIP,
+		rids:         rids,
+		remoteTracks: make(map[webrtc.RTPCodecType]*webrtc.TrackRemote),
+		layers:       make(map[string]*whipLayer),
+	}
+	pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		log.Println("WHIP track:", name, remoteTrack.Kind().String(), remoteTrack.Codec().MimeType, remoteTrack.RID())
+		s.senders.Add(1)
+		go func() {
+			defer s.senders.Done()
+			c.forward(remoteTrack)
+		}()
+	})
+	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		log.Println("pc state change:", connectionState.String())
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			c.streaming()
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			h.deleteWhipClient(resource)
+		}
+	})
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offerStr,
+	}); err != nil {
+		return "", "", wrapError(errUnacceptableSDP, err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", "", wrapError(errUnacceptableSDP, err)
+	}
+	pc.OnICECandidate(c.trickle.onCandidate)
+	if err = pc.SetLocalDescription(answer); err != nil {
+		return "", "", err
+	}
+	c.trickle.reset()
+	answerSDP := pc.LocalDescription().SDP
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	// another publisher may have been added while this one was negotiated
+	if s.Publisher() != nil {
+		return "", "", errStreamConflict
+	}
+	s.SetPublisher(c)
+	h.mapWhipClients[resource] = c
+	added = true
+	h.leaveStream(s)
+	c.connecting(h.connectTimeout, func() {
+		log.Println("WHIP Client connect timeout:", resource)
+		h.deleteWhipClient(resource)
+	})
+	log.Println("Add WHIP Client:", resource, rids)
+	return resource, answerSDP, nil
+}
+
+func (h *whepHandler) deleteWhipClient(resource string) error {
+	h.locker.Lock()
+	c, ok := h.mapWhipClients[resource]
+	if !ok {
+		h.locker.Unlock()
+		return errSessionNotExist
+	}
+	c.closing()
+	c.stream.UnsetPublisher(c)
+	h.releaseStream(c.stream)
+	delete(h.mapWhipClients, resource)
+	h.admission.leave("", c.clientIP)
+	h.locker.Unlock()
+	c.pc.Close()
+	log.Println("Remove WHIP Client:", resource)
+	return nil
+}
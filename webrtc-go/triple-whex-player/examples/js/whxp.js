@@ -23,9 +23,10 @@ var whepClient03 = null;
 // Initialize
 window.onload = () => {
   var baseUrl = window.location.protocol + '//' + window.location.hostname + ':8082';
-  whepUrlTextarea01.value = baseUrl + '/live/test01.whep';
-  whepUrlTextarea02.value = baseUrl + '/live/test02.whep';
-  whepUrlTextarea03.value = baseUrl + '/live/test03.whep';
+  // the three simulcast layers of a WHIP publish to /live/livestream.whip
+  whepUrlTextarea01.value = baseUrl + '/live/livestream.whep?layer=h';
+  whepUrlTextarea02.value = baseUrl + '/live/livestream.whep?layer=m';
+  whepUrlTextarea03.value = baseUrl + '/live/livestream.whep?layer=l';
   whepStartButton.addEventListener('click', whepStart);
   whepStopButton.addEventListener('click', whepStop);
 }
@@ -80,23 +81,57 @@ class WHEPClient {
       }
     });
 
+    // the local candidates, null once gathered, wait for the session
+    // resource before they are trickled
+    this.pendingCandidates = [];
+    this.peerConnection.addEventListener('icecandidate', ev => {
+      this.pendingCandidates.push(ev.candidate);
+      this.trickleCandidates();
+    });
+
     this.peerConnection.addEventListener('negotiationneeded', async ev => {
       console.log('Connection negotiation starting');
-      await negotiateConnectionWithClientOffer(this.peerConnection, this.endpoint, this.token);
+      this.resourceUrl = await negotiateConnectionWithClientOffer(this.peerConnection, this.endpoint, this.token);
       console.log('Connection negotiation ended');
+      this.trickleCandidates();
     });
   }
 
+  // PATCHes the pending local candidates to the session, the server answers
+  // with its candidates gathered after its SDP answer.
+  async trickleCandidates() {
+    if (!this.resourceUrl || this.pendingCandidates.length === 0) {
+      return;
+    }
+    const candidates = this.pendingCandidates;
+    this.pendingCandidates = [];
+    const response = await fetch(this.resourceUrl, {
+      method: 'PATCH',
+      mode: 'cors',
+      headers: Object.assign({ 'Content-Type': 'application/trickle-ice-sdpfrag' }, authHeaders(this.token)),
+      body: sdpFragment(this.peerConnection.localDescription.sdp, candidates),
+    });
+    if (response.status !== 200) {
+      return;
+    }
+    for (const candidate of fragmentCandidates(await response.text())) {
+      await this.peerConnection.addIceCandidate(candidate);
+    }
+  }
+
   async disconnectStream() {
     this.videoElement.srcObject = null;
     this.streamVisualizer.stop();
     this.streamVisualizer = null;
 
     var _b;
-    const response = await fetch(this.endpoint, {
-      method: 'DELETE',
-      mode: 'cors',
-    });
+    if (this.resourceUrl) {
+      await fetch(this.resourceUrl, {
+        method: 'DELETE',
+        mode: 'cors',
+        headers: authHeaders(this.token),
+      });
+    }
     this.peerConnection.close();
     (_b = this.localStream) === null || _b === void 0
       ? void 0
@@ -106,6 +141,10 @@ class WHEPClient {
 
 // Performs the actual SDP exchange.
 async function negotiateConnectionWithClientOffer(peerConnection, endpoint, token) {
+  const iceServers = await fetchIceServers(endpoint, token);
+  if (iceServers.length > 0) {
+    peerConnection.setConfiguration(Object.assign(peerConnection.getConfiguration(), { iceServers }));
+  }
   const offer = await peerConnection.createOffer();
   console.log(`whxp client offer sdp:\n%c${offer.sdp}`, 'color:magenta');
   await peerConnection.setLocalDescription(offer);
@@ -117,7 +156,10 @@ async function negotiateConnectionWithClientOffer(peerConnection, endpoint, toke
       await peerConnection.setRemoteDescription(
         new RTCSessionDescription({ type: 'answer', sdp: answerSDP })
       );
-      return response.headers.get('Location');
+      return new URL(response.headers.get('Location'), endpoint).href;
+    } else if (response.status === 401 || response.status === 403) {
+      console.error('Check the token passed into the WHIP or WHEP client');
+      return;
     } else if (response.status === 405) {
       console.error('Update the URL passed into the WHIP or WHEP client');
     } else {
@@ -133,14 +175,83 @@ async function postSDPOffer(endpoint, token, data) {
   return await fetch(endpoint, {
     method: 'POST',
     mode: 'cors',
-    headers: {
-      'Content-Type': 'application/sdp',
-      'Authorization': 'Bearer ' + token,
-    },
+    headers: Object.assign({ 'Content-Type': 'application/sdp' }, authHeaders(token)),
     body: data,
   });
 }
 
+// Asks the endpoint for the STUN/TURN servers it advertises in Link headers.
+async function fetchIceServers(endpoint, token) {
+  try {
+    const response = await fetch(endpoint, {
+      method: 'OPTIONS',
+      mode: 'cors',
+      headers: authHeaders(token),
+    });
+    return parseIceServerLinks(response.headers.get('Link'));
+  } catch (e) {
+    console.error(e);
+    return [];
+  }
+}
+
+function parseIceServerLinks(header) {
+  const iceServers = [];
+  const links = (header || '').match(/<[^>]+>(\s*;\s*[^;,=]+=("[^"]*"|[^;,]*))*/g) || [];
+  for (const link of links) {
+    const params = {};
+    for (const m of link.matchAll(/;\s*([^;,=\s]+)=("([^"]*)"|[^;,]*)/g)) {
+      params[m[1].toLowerCase()] = m[3] !== undefined ? m[3] : m[2];
+    }
+    if (params.rel !== 'ice-server') {
+      continue;
+    }
+    const server = { urls: link.match(/<([^>]+)>/)[1] };
+    if (params.username) {
+      server.username = params.username;
+    }
+    if (params.credential) {
+      server.credential = params.credential;
+    }
+    iceServers.push(server);
+  }
+  return iceServers;
+}
+
+// Builds the trickle-ice-sdpfrag of the candidates for the first media
+// section, a null candidate is the end of candidates.
+function sdpFragment(sdp, candidates) {
+  const lines = sdp.split('\r\n');
+  const first = prefix => lines.find(line => line.startsWith(prefix));
+  const frag = [first('a=ice-ufrag:'), first('a=ice-pwd:'), first('m='), first('a=mid:')];
+  for (const candidate of candidates) {
+    if (candidate === null) {
+      frag.push('a=end-of-candidates');
+    } else if (candidate.candidate) {
+      frag.push('a=' + candidate.candidate);
+    }
+  }
+  return frag.join('\r\n') + '\r\n';
+}
+
+// Reads the candidates of a trickle-ice-sdpfrag answer.
+function fragmentCandidates(frag) {
+  const candidates = [];
+  let mid = null;
+  for (const line of frag.split(/\r?\n/)) {
+    if (line.startsWith('a=mid:')) {
+      mid = line.substring('a=mid:'.length);
+    } else if (line.startsWith('a=candidate:')) {
+      candidates.push({ candidate: line.substring(2), sdpMid: mid });
+    }
+  }
+  return candidates;
+}
+
+function authHeaders(token) {
+  return token ? { 'Authorization': 'Bearer ' + token } : {};
+}
+
 function whepStart() {
   whepClient01 = new WHEPClient(whepUrlTextarea01.value, "", subAudioCanvas01, subVideoVideo01);
   whepClient02 = new WHEPClient(whepUrlTextarea02.value, "", subAudioCanvas02, subVideoVideo02);
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/aggresss/playground-streaming/webrtc-go/internal/whep"
+
+func main() {
+	whep.Main(whep.DEFAULT_PROFILE)
+}